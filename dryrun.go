@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/adnanh/webhook/internal/hook"
+)
+
+// Exit codes of a dry run.
+const (
+	dryRunTriggered    = 0
+	dryRunNotTriggered = 1
+	dryRunFailed       = 2
+)
+
+// runDryRun evaluates the trigger rules of the hook with the given ID against
+// the raw HTTP request read from the file at path, as if sent from
+// remoteAddr, writing the rule evaluation trace and the result to w. It
+// returns the exit code of the dry run.
+func runDryRun(w io.Writer, id, path, remoteAddr string) int {
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	var h *hook.Hook
+
+	for _, hooksFilePath := range hooksFiles {
+		hooks := hook.Hooks{}
+
+		if err := hooks.LoadFromFile(hooksFilePath, *asTemplate); err != nil {
+			fmt.Fprintf(w, "error: couldn't load hooks from %s: %v\n", hooksFilePath, err)
+			return dryRunFailed
+		}
+
+		if h == nil {
+			h = hooks.Match(id)
+		}
+	}
+
+	if h == nil {
+		fmt.Fprintf(w, "error: hook %q not found\n", id)
+		return dryRunFailed
+	}
+
+	f := os.Stdin
+	if path != "-" {
+		var err error
+
+		f, err = os.Open(path)
+		if err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+			return dryRunFailed
+		}
+		defer f.Close()
+	}
+
+	r, err := http.ReadRequest(bufio.NewReader(f))
+	if err != nil {
+		fmt.Fprintf(w, "error: reading request: %v\n", err)
+		return dryRunFailed
+	}
+
+	r.RemoteAddr = remoteAddr
+
+	req := &hook.Request{
+		ID:         "dry-run",
+		HookID:     h.ID,
+		RawRequest: r,
+	}
+	defer req.RemoveFiles()
+
+	if err := parseRequest(nil, h, req, r); err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+		return dryRunFailed
+	}
+
+	ok, trace, err := evaluateRules(h, req, true)
+
+	if trace != nil {
+		fmt.Fprintln(w, trace)
+	}
+
+	switch {
+	case err != nil && !hook.IsParameterNodeError(err):
+		fmt.Fprintf(w, "error evaluating hook %q: %v\n", id, err)
+		return dryRunFailed
+	case ok:
+		fmt.Fprintf(w, "hook %q would be triggered\n", id)
+		return dryRunTriggered
+	default:
+		fmt.Fprintf(w, "hook %q would not be triggered\n", id)
+		return dryRunNotTriggered
+	}
+}
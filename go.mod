@@ -11,10 +11,12 @@ require (
 	github.com/gofrs/uuid v3.2.0+incompatible
 	github.com/gorilla/mux v1.7.3
 	github.com/kisielk/errcheck v1.6.2 // indirect
+	github.com/klauspost/compress v1.15.12
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/ohler55/ojg v1.14.5
 	github.com/oliveagle/jsonpath v0.0.0-20180606110733-2e52cf6e6852
 	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/sys v0.3.0
 	golang.org/x/tools v0.4.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
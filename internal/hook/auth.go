@@ -0,0 +1,197 @@
+package hook
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultAuthRealm is the default realm of authentication challenges.
+const DefaultAuthRealm = "webhook"
+
+// Auth configures the HTTP authentication of the requests to a hook. A
+// request is authenticated if it carries the credentials of any of the basic
+// auth users or any of the bearer tokens.
+type Auth struct {
+	// Realm is the realm sent in authentication challenges.
+	Realm string `json:"realm,omitempty"`
+	// Basic lists the users allowed to authenticate with HTTP basic
+	// authentication.
+	Basic []BasicAuthUser `json:"basic,omitempty"`
+	// HtpasswdFile is the path to an htpasswd file of additional basic
+	// auth users. Only bcrypt password hashes are supported.
+	HtpasswdFile string `json:"htpasswd-file,omitempty"`
+	// BearerTokens lists the accepted bearer tokens.
+	BearerTokens []RuleSecret `json:"bearer-tokens,omitempty"`
+
+	users map[string][]byte
+
+	// dummyHash is compared against when the user is unknown, so that the
+	// time taken does not reveal whether a user exists. It has the highest
+	// cost of the users' hashes, so that it takes as long to compare.
+	dummyHash []byte
+}
+
+// BasicAuthUser is a user allowed to authenticate with HTTP basic
+// authentication.
+type BasicAuthUser struct {
+	Username string `json:"username,omitempty"`
+	// Password is the bcrypt hash of the user's password.
+	Password string `json:"password,omitempty"`
+}
+
+// prepare loads the users and tokens and validates the configuration.
+func (a *Auth) prepare(c *configChecker, path string) {
+	a.users = make(map[string][]byte)
+
+	for i, u := range a.Basic {
+		p := fmt.Sprintf("%s.basic[%d]", path, i)
+
+		if err := a.addUser(u.Username, u.Password); err != nil {
+			c.add(p, err)
+		}
+	}
+
+	if a.HtpasswdFile != "" {
+		if err := a.loadHtpasswd(); err != nil {
+			c.add(path+".htpasswd-file", err)
+		}
+	}
+
+	for i := range a.BearerTokens {
+		p := fmt.Sprintf("%s.bearer-tokens[%d]", path, i)
+
+		a.BearerTokens[i].prepare(c, p)
+
+		if a.BearerTokens[i].Value == "" && a.BearerTokens[i].File == "" && a.BearerTokens[i].Env == "" {
+			c.add(p, errors.New("token is empty"))
+		}
+	}
+
+	if len(a.users) == 0 && len(a.BearerTokens) == 0 {
+		c.add(path, errors.New("no users or bearer tokens configured"))
+	}
+
+	a.dummyHash = nil
+	if len(a.users) > 0 {
+		cost := bcrypt.MinCost
+		for _, hash := range a.users {
+			if n, _ := bcrypt.Cost(hash); n > cost {
+				cost = n
+			}
+		}
+
+		var err error
+
+		a.dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+		if err != nil {
+			c.add(path, err)
+		}
+	}
+}
+
+// addUser adds a basic auth user with the bcrypt password hash.
+func (a *Auth) addUser(username, hash string) error {
+	if username == "" {
+		return errors.New("missing username")
+	}
+
+	if strings.Contains(username, ":") {
+		return fmt.Errorf("username %q must not contain a colon", username)
+	}
+
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("password of user %q must be a bcrypt hash", username)
+	}
+
+	a.users[username] = []byte(hash)
+
+	return nil
+}
+
+// loadHtpasswd adds the users of the htpasswd file.
+func (a *Auth) loadHtpasswd() error {
+	f, err := os.Open(a.HtpasswdFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := strings.SplitN(line, ":", 2)
+		if len(p) != 2 {
+			return fmt.Errorf("line %d: invalid entry", n)
+		}
+
+		if err := a.addUser(p[0], p[1]); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+
+	return s.Err()
+}
+
+// Authenticate returns true if the request carries valid credentials.
+func (a *Auth) Authenticate(r *http.Request) bool {
+	if username, password, ok := r.BasicAuth(); ok && len(a.users) > 0 {
+		hash, ok := a.users[username]
+		if !ok {
+			hash = a.dummyHash
+		}
+
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && ok
+	}
+
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimSpace(h[7:])
+	now := time.Now()
+
+	valid := false
+	for i := range a.BearerTokens {
+		// Check all tokens so that the time taken does not depend on
+		// which token matched.
+		if !a.BearerTokens[i].Expired(now) && compare(token, a.BearerTokens[i].Value) {
+			valid = true
+		}
+	}
+
+	return valid
+}
+
+// Challenges returns the WWW-Authenticate challenges for the configured
+// authentication schemes.
+func (a *Auth) Challenges() []string {
+	realm := a.Realm
+	if realm == "" {
+		realm = DefaultAuthRealm
+	}
+
+	var res []string
+
+	if len(a.users) > 0 {
+		res = append(res, fmt.Sprintf("Basic realm=%q", realm))
+	}
+
+	if len(a.BearerTokens) > 0 {
+		res = append(res, fmt.Sprintf("Bearer realm=%q", realm))
+	}
+
+	return res
+}
@@ -0,0 +1,71 @@
+package hook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// compareNumbers compares the numeric parameter value arg with value using
+// the comparison of the match type t. A value that is not a number never
+// matches.
+func compareNumbers(t, arg, value string) bool {
+	a, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+	if err != nil {
+		return false
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+
+	switch t {
+	case MatchGreaterThan:
+		return a > v
+	case MatchGreaterOrEqual:
+		return a >= v
+	case MatchLessThan:
+		return a < v
+	case MatchLessOrEqual:
+		return a <= v
+	}
+
+	return false
+}
+
+// inValues returns true if arg equals any of values.
+func inValues(arg string, values []string) bool {
+	for _, v := range values {
+		if arg == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsValue returns true if arg contains value. If arg is a JSON array,
+// as extracted from an array parameter, it must have an element equal to
+// value; otherwise value must be a substring of arg.
+func containsValue(arg, value string) bool {
+	if strings.HasPrefix(arg, "[") {
+		var list []interface{}
+
+		decoder := json.NewDecoder(strings.NewReader(arg))
+		decoder.UseNumber()
+
+		if decoder.Decode(&list) == nil {
+			for _, e := range list {
+				if fmt.Sprintf("%v", e) == value {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	return strings.Contains(arg, value)
+}
@@ -0,0 +1,127 @@
+package hook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrBodyTooLarge is returned by DecodeBody if the decoded body is larger
+// than the limit.
+var ErrBodyTooLarge = errors.New("decoded request body is too large")
+
+// UnsupportedEncodingError is returned by DecodeBody for a content coding it
+// does not support.
+type UnsupportedEncodingError struct {
+	Encoding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported content encoding %q", e.Encoding)
+}
+
+// IsUnsupportedEncodingError returns whether err is of type
+// UnsupportedEncodingError.
+func IsUnsupportedEncodingError(err error) bool {
+	_, ok := err.(*UnsupportedEncodingError)
+	return ok
+}
+
+// DecodeBody decodes the request body according to encoding, the value of
+// the Content-Encoding header listing the content codings applied to the body
+// in order. The gzip, deflate and zstd codings are supported. The body as
+// received is kept in RawBody. If the decoded body is larger than max bytes,
+// ErrBodyTooLarge is returned, unless max is 0. Unsupported codings return an
+// UnsupportedEncodingError; other errors mean the body is corrupt.
+func (r *Request) DecodeBody(encoding string, max int64) error {
+	codings := strings.Split(encoding, ",")
+	body := r.Body
+
+	for i := len(codings) - 1; i >= 0; i-- {
+		c := strings.ToLower(strings.TrimSpace(codings[i]))
+		if c == "" || c == "identity" {
+			continue
+		}
+
+		var err error
+
+		body, err = decodeBody(body, c, max)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.RawBody = r.Body
+	r.Body = body
+
+	return nil
+}
+
+// decodeBody decodes b, encoded with the content coding c.
+func decodeBody(b []byte, c string, max int64) ([]byte, error) {
+	var (
+		rd  io.Reader
+		err error
+	)
+
+	switch c {
+	case "gzip", "x-gzip":
+		rd, err = gzip.NewReader(bytes.NewReader(b))
+
+	case "deflate":
+		// The deflate coding is zlib data, but some senders send raw
+		// deflate data instead.
+		rd, err = zlib.NewReader(bytes.NewReader(b))
+		if err == zlib.ErrHeader {
+			rd, err = flate.NewReader(bytes.NewReader(b)), nil
+		}
+
+	case "zstd":
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if max > 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(max)))
+		}
+
+		var d *zstd.Decoder
+
+		d, err = zstd.NewReader(bytes.NewReader(b), opts...)
+		if err == nil {
+			defer d.Close()
+			rd = d
+		}
+
+	default:
+		return nil, &UnsupportedEncodingError{c}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s request body: %v", c, err)
+	}
+
+	if max > 0 {
+		rd = io.LimitReader(rd, max+1)
+	}
+
+	out, err := ioutil.ReadAll(rd)
+	if err == zstd.ErrWindowSizeExceeded || err == zstd.ErrDecoderSizeExceeded {
+		// The zstd window would not fit within the limit.
+		return nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s request body: %v", c, err)
+	}
+
+	if max > 0 && int64(len(out)) > max {
+		return nil, ErrBodyTooLarge
+	}
+
+	return out, nil
+}
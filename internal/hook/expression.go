@@ -0,0 +1,937 @@
+package hook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a boolean expression over the values of a request, such as
+//
+//	payload.ref == "refs/heads/main" && headers["X-GitHub-Event"] in ["push", "release"]
+//
+// Expressions are compiled once, when the hooks are loaded, and have no side
+// effects when they are evaluated.
+type Expression struct {
+	src  string
+	root exprNode
+}
+
+// NewExpression compiles the expression src.
+func NewExpression(src string) (*Expression, error) {
+	e := &Expression{src: src}
+
+	if err := e.compile(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// UnmarshalJSON unmarshals the source of an expression. The expression is
+// compiled when the hooks are prepared.
+func (e *Expression) UnmarshalJSON(b []byte) error {
+	e.root = nil
+	return json.Unmarshal(b, &e.src)
+}
+
+// MarshalJSON marshals the source of an expression.
+func (e Expression) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.src)
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.src
+}
+
+// compile parses the expression.
+func (e *Expression) compile() error {
+	if strings.TrimSpace(e.src) == "" {
+		return errExpressionEmpty
+	}
+
+	p := &exprParser{src: e.src}
+
+	if err := p.next(); err != nil {
+		return err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return err
+	}
+
+	if p.tok.kind != tokEOF {
+		return p.errorf("unexpected %s", p.tok)
+	}
+
+	e.root = root
+
+	return nil
+}
+
+// Evaluate evaluates the expression for the request. The expression must
+// evaluate to a boolean. It must have been compiled, by NewExpression or when
+// the hooks were prepared, so that it is not modified while requests are
+// served concurrently.
+func (e *Expression) Evaluate(req *Request) (bool, error) {
+	if e.root == nil {
+		return false, fmt.Errorf("expression %q is not compiled", e.src)
+	}
+
+	v, err := e.root.eval(req)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q evaluated to %s, not a boolean", e.src, describe(v))
+	}
+
+	return b, nil
+}
+
+// Token kinds of the expression language.
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+
+	return strconv.Quote(t.text)
+}
+
+// exprParser is a recursive descent parser of the expression language.
+type exprParser struct {
+	src string
+	off int
+	tok exprToken
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+// next scans the next token.
+func (p *exprParser) next() error {
+	for p.off < len(p.src) && unicode.IsSpace(rune(p.src[p.off])) {
+		p.off++
+	}
+
+	start := p.off
+	prev := p.tok
+	p.tok = exprToken{kind: tokEOF, pos: start}
+
+	if p.off >= len(p.src) {
+		return nil
+	}
+
+	c := p.src[p.off]
+
+	switch {
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.off < len(p.src) && (p.src[p.off] == '_' || unicode.IsLetter(rune(p.src[p.off])) || unicode.IsDigit(rune(p.src[p.off]))) {
+			p.off++
+		}
+
+		p.tok = exprToken{kind: tokIdent, text: p.src[start:p.off], pos: start}
+
+	case c >= '0' && c <= '9' || c == '-' && p.off+1 < len(p.src) && p.src[p.off+1] >= '0' && p.src[p.off+1] <= '9':
+		// A number following a field selector is an index, as in
+		// commits.0.id, so it cannot have a fraction.
+		digits := "0123456789.eE"
+		if prev.kind == tokOp && prev.text == "." {
+			digits = "0123456789"
+		}
+
+		p.off++
+		for p.off < len(p.src) && strings.IndexByte(digits, p.src[p.off]) != -1 {
+			p.off++
+		}
+
+		p.tok = exprToken{kind: tokNumber, text: p.src[start:p.off], pos: start}
+
+	case c == '"' || c == '\'':
+		p.off++
+		for p.off < len(p.src) && p.src[p.off] != c {
+			if p.src[p.off] == '\\' {
+				p.off++
+			}
+			p.off++
+		}
+
+		if p.off >= len(p.src) {
+			return fmt.Errorf("at offset %d: unterminated string", start)
+		}
+
+		p.off++
+
+		text := p.src[start:p.off]
+		if c == '\'' {
+			// Single quoted strings use the same escapes.
+			text = `"` + strings.ReplaceAll(strings.ReplaceAll(text[1:len(text)-1], `\'`, `'`), `"`, `\"`) + `"`
+		}
+
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return fmt.Errorf("at offset %d: invalid string: %v", start, err)
+		}
+
+		p.tok = exprToken{kind: tokString, text: s, pos: start}
+
+	default:
+		for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ".", ","} {
+			if strings.HasPrefix(p.src[p.off:], op) {
+				p.off += len(op)
+				p.tok = exprToken{kind: tokOp, text: op, pos: start}
+				return nil
+			}
+		}
+
+		return fmt.Errorf("at offset %d: unexpected character %q", start, c)
+	}
+
+	return nil
+}
+
+// is returns true if the current token is the operator or keyword s.
+func (p *exprParser) is(s string) bool {
+	return (p.tok.kind == tokOp || p.tok.kind == tokIdent) && p.tok.text == s
+}
+
+// expect consumes the operator s.
+func (p *exprParser) expect(s string) error {
+	if !p.is(s) {
+		return p.errorf("expected %q, found %s", s, p.tok)
+	}
+
+	return p.next()
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.is("||") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		x = &exprLogical{or: true, x: x, y: y}
+	}
+
+	return x, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.is("&&") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		x = &exprLogical{x: x, y: y}
+	}
+
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.is("!") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &exprNot{x: x}, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.tok.text
+
+	switch {
+	case p.is("==") || p.is("!=") || p.is("<") || p.is("<=") || p.is(">") || p.is(">=") || p.is("in"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+	case p.is("not"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+
+		op = "not in"
+
+	default:
+		return x, nil
+	}
+
+	y, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &exprCompare{op: op, x: x, y: y}, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.tok
+
+	var (
+		x   exprNode
+		err error
+	)
+
+	switch {
+	case tok.kind == tokString:
+		x = exprLiteral{v: tok.text}
+		err = p.next()
+
+	case tok.kind == tokNumber:
+		f, perr := strconv.ParseFloat(tok.text, 64)
+		if perr != nil {
+			return nil, p.errorf("invalid number %s", tok)
+		}
+
+		x = exprLiteral{v: f}
+		err = p.next()
+
+	case p.is("("):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+
+		if x, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+
+		err = p.expect(")")
+
+	case p.is("["):
+		x, err = p.parseList()
+
+	case tok.kind == tokIdent:
+		x, err = p.parseIdent()
+
+	default:
+		return nil, p.errorf("unexpected %s", tok)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return p.parseSelectors(x)
+}
+
+// parseList parses a list literal.
+func (p *exprParser) parseList() (exprNode, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+
+	list := &exprList{}
+
+	for !p.is("]") {
+		if len(list.items) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		list.items = append(list.items, x)
+	}
+
+	return list, p.next()
+}
+
+// parseIdent parses a keyword, a request value or a function call.
+func (p *exprParser) parseIdent() (exprNode, error) {
+	tok := p.tok
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	switch tok.text {
+	case "true":
+		return exprLiteral{v: true}, nil
+	case "false":
+		return exprLiteral{v: false}, nil
+	case "null":
+		return exprLiteral{v: nil}, nil
+	}
+
+	if p.is("(") {
+		return p.parseCall(tok)
+	}
+
+	if _, ok := exprRoots[tok.text]; !ok {
+		return nil, fmt.Errorf("at offset %d: unknown identifier %q", tok.pos, tok.text)
+	}
+
+	return exprRoot(tok.text), nil
+}
+
+// parseCall parses the arguments of a call of the function named by tok.
+func (p *exprParser) parseCall(tok exprToken) (exprNode, error) {
+	fn, ok := exprFuncs[tok.text]
+	if !ok {
+		return nil, fmt.Errorf("at offset %d: unknown function %q", tok.pos, tok.text)
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	call := &exprCall{name: tok.text, fn: fn}
+
+	for !p.is(")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		call.args = append(call.args, x)
+	}
+
+	if len(call.args) != fn.args {
+		return nil, fmt.Errorf("at offset %d: %s expects %d arguments, found %d", tok.pos, tok.text, fn.args, len(call.args))
+	}
+
+	// Regular expressions must be literals so that they are compiled, and
+	// checked, along with the expression.
+	if tok.text == "matches" {
+		lit, ok := call.args[1].(exprLiteral)
+		s, isString := lit.v.(string)
+		if !ok || !isString {
+			return nil, fmt.Errorf("at offset %d: matches expects a string literal regular expression", tok.pos)
+		}
+
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("at offset %d: %v", tok.pos, err)
+		}
+
+		call.re = re
+	}
+
+	return call, p.next()
+}
+
+// parseSelectors parses the field and index selectors following x.
+func (p *exprParser) parseSelectors(x exprNode) (exprNode, error) {
+	for {
+		switch {
+		case p.is("."):
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+
+			if p.tok.kind != tokIdent && p.tok.kind != tokNumber {
+				return nil, p.errorf("expected field name, found %s", p.tok)
+			}
+
+			x = &exprIndex{x: x, key: exprLiteral{v: p.tok.text}}
+
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+
+		case p.is("["):
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+
+			key, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+
+			x = &exprIndex{x: x, key: key}
+
+		default:
+			// The last selector resolves repeated values to their
+			// first value.
+			if idx, ok := x.(*exprIndex); ok {
+				idx.first = true
+			}
+
+			return x, nil
+		}
+	}
+}
+
+// exprNode is a node of a compiled expression.
+type exprNode interface {
+	eval(req *Request) (interface{}, error)
+}
+
+type exprLiteral struct {
+	v interface{}
+}
+
+func (n exprLiteral) eval(req *Request) (interface{}, error) {
+	return n.v, nil
+}
+
+// exprRoots lists the request values available in expressions.
+var exprRoots = map[string]func(req *Request) interface{}{
+	"payload": func(req *Request) interface{} { return req.Payload },
+	"headers": func(req *Request) interface{} { return exprHeaders(req.Headers) },
+	"query":   func(req *Request) interface{} { return req.Query },
+	"claims":  func(req *Request) interface{} { return req.Claims },
+	"body":    func(req *Request) interface{} { return string(req.Body) },
+	"request": func(req *Request) interface{} {
+		m := map[string]interface{}{"remote-addr": req.ClientAddr()}
+		if req.RawRequest != nil {
+			m["method"] = req.RawRequest.Method
+		}
+		return m
+	},
+}
+
+// exprHeaders is a map of headers whose keys are looked up in canonical
+// form.
+type exprHeaders map[string]interface{}
+
+type exprRoot string
+
+func (n exprRoot) eval(req *Request) (interface{}, error) {
+	return exprRoots[string(n)](req), nil
+}
+
+type exprList struct {
+	items []exprNode
+}
+
+func (n *exprList) eval(req *Request) (interface{}, error) {
+	res := make([]interface{}, len(n.items))
+
+	for i := range n.items {
+		v, err := n.items[i].eval(req)
+		if err != nil {
+			return nil, err
+		}
+
+		res[i] = v
+	}
+
+	return res, nil
+}
+
+// exprIndex selects a field of a map or an element of a list. Selecting a
+// missing field or element yields null.
+type exprIndex struct {
+	x, key exprNode
+
+	// first is set if the selected value is not selected from further, so
+	// that RepeatedValues yield their first value.
+	first bool
+}
+
+func (n *exprIndex) eval(req *Request) (interface{}, error) {
+	v, err := n.x.eval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := n.key.eval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var res interface{}
+
+	switch m := v.(type) {
+	case exprHeaders:
+		res = m[textproto.CanonicalMIMEHeaderKey(fmt.Sprint(k))]
+
+	case map[string]interface{}:
+		res = m[fmt.Sprint(k)]
+
+	case RepeatedValues:
+		res = indexList(m, k)
+
+	case []interface{}:
+		res = indexList(m, k)
+	}
+
+	if n.first {
+		return firstValue(res), nil
+	}
+
+	return res, nil
+}
+
+// indexList returns the element of l at index k, or nil if there is none.
+func indexList(l []interface{}, k interface{}) interface{} {
+	f, ok := toNumber(k)
+	if !ok || f < 0 || int(f) >= len(l) || f != float64(int(f)) {
+		return nil
+	}
+
+	return l[int(f)]
+}
+
+type exprNot struct {
+	x exprNode
+}
+
+func (n *exprNot) eval(req *Request) (interface{}, error) {
+	v, err := n.x.eval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("operand of ! is %s, not a boolean", describe(v))
+	}
+
+	return !b, nil
+}
+
+// exprLogical is a short-circuit && or || operation.
+type exprLogical struct {
+	or   bool
+	x, y exprNode
+}
+
+func (n *exprLogical) eval(req *Request) (interface{}, error) {
+	for _, operand := range []exprNode{n.x, n.y} {
+		v, err := operand.eval(req)
+		if err != nil {
+			return nil, err
+		}
+
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operand of %s is %s, not a boolean", map[bool]string{true: "||", false: "&&"}[n.or], describe(v))
+		}
+
+		if b == n.or {
+			return b, nil
+		}
+	}
+
+	return !n.or, nil
+}
+
+type exprCompare struct {
+	op   string
+	x, y exprNode
+}
+
+func (n *exprCompare) eval(req *Request) (interface{}, error) {
+	x, err := n.x.eval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := n.y.eval(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(x, y), nil
+	case "!=":
+		return !exprEqual(x, y), nil
+	case "in":
+		return exprIn(x, y), nil
+	case "not in":
+		return !exprIn(x, y), nil
+	}
+
+	// Ordered comparisons compare numbers, or strings if either operand
+	// is not a number. Comparisons with null are false.
+	if x == nil || y == nil {
+		return false, nil
+	}
+
+	var c int
+
+	a, aok := toNumber(x)
+	b, bok := toNumber(y)
+
+	switch {
+	case aok && bok:
+		switch {
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		}
+	default:
+		as, aok := x.(string)
+		bs, bok := y.(string)
+		if !aok || !bok {
+			return false, nil
+		}
+
+		c = strings.Compare(as, bs)
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+// exprFunc is a function available in expressions.
+type exprFunc struct {
+	args int
+	fn   func(call *exprCall, args []interface{}) interface{}
+}
+
+var exprFuncs = map[string]exprFunc{
+	"contains": {2, func(_ *exprCall, a []interface{}) interface{} {
+		if s, ok := a[0].(string); ok {
+			return strings.Contains(s, fmt.Sprint(a[1]))
+		}
+		return exprIn(a[1], a[0])
+	}},
+	"prefix": {2, func(_ *exprCall, a []interface{}) interface{} {
+		s, ok := a[0].(string)
+		return ok && strings.HasPrefix(s, fmt.Sprint(a[1]))
+	}},
+	"suffix": {2, func(_ *exprCall, a []interface{}) interface{} {
+		s, ok := a[0].(string)
+		return ok && strings.HasSuffix(s, fmt.Sprint(a[1]))
+	}},
+	"matches": {2, func(call *exprCall, a []interface{}) interface{} {
+		s, ok := a[0].(string)
+		return ok && call.re.MatchString(s)
+	}},
+	"exists": {1, func(_ *exprCall, a []interface{}) interface{} {
+		return a[0] != nil
+	}},
+	"lower": {1, func(_ *exprCall, a []interface{}) interface{} {
+		if s, ok := a[0].(string); ok {
+			return strings.ToLower(s)
+		}
+		return a[0]
+	}},
+	"len": {1, func(_ *exprCall, a []interface{}) interface{} {
+		switch v := a[0].(type) {
+		case string:
+			return float64(len(v))
+		case []interface{}:
+			return float64(len(v))
+		case map[string]interface{}:
+			return float64(len(v))
+		}
+		return float64(0)
+	}},
+}
+
+type exprCall struct {
+	name string
+	fn   exprFunc
+	args []exprNode
+	re   *regexp.Regexp
+}
+
+func (n *exprCall) eval(req *Request) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+
+	for i := range n.args {
+		v, err := n.args[i].eval(req)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = v
+	}
+
+	return n.fn.fn(n, args), nil
+}
+
+// exprEqual compares two values. Numbers are compared numerically, also
+// when one of them is a string holding a number, such as a header value.
+func exprEqual(x, y interface{}) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+
+	a, aok := toNumber(x)
+	b, bok := toNumber(y)
+
+	if aok && bok {
+		_, xs := x.(string)
+		_, ys := y.(string)
+
+		// Two strings are compared as strings.
+		if !xs || !ys {
+			return a == b
+		}
+	}
+
+	return reflect.DeepEqual(normalize(x), normalize(y))
+}
+
+// exprIn returns true if x is an element of the list y, a key of the map y,
+// or a substring of the string y.
+func exprIn(x, y interface{}) bool {
+	switch v := y.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if exprEqual(x, e) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		_, ok := v[fmt.Sprint(x)]
+		return ok
+	case exprHeaders:
+		_, ok := v[textproto.CanonicalMIMEHeaderKey(fmt.Sprint(x))]
+		return ok
+	case string:
+		s, ok := x.(string)
+		return ok && strings.Contains(v, s)
+	}
+
+	return false
+}
+
+// toNumber converts numbers, and strings holding numbers, to float64.
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	case int:
+		return float64(n), true
+	}
+
+	return 0, false
+}
+
+// normalize converts json.Number values to float64 so that they compare
+// equal to number literals.
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case json.Number:
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	case exprHeaders:
+		return map[string]interface{}(n)
+	case []interface{}:
+		res := make([]interface{}, len(n))
+		for i := range n {
+			res[i] = normalize(n[i])
+		}
+		return res
+	}
+
+	return v
+}
+
+// describe returns a short description of the type of v for error messages.
+func describe(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}, exprHeaders:
+		return "an object"
+	}
+
+	if _, ok := toNumber(v); ok {
+		return "a number"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+// errExpressionEmpty is returned for an empty expression.
+var errExpressionEmpty = errors.New("empty expression")
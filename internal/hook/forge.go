@@ -0,0 +1,68 @@
+package hook
+
+import (
+	"errors"
+
+	"github.com/adnanh/webhook/internal/redact"
+)
+
+// Webhook headers of GitLab, Gitea, Gogs and Bitbucket Server.
+const (
+	GitLabTokenHeader              = "X-Gitlab-Token"
+	GiteaSignatureHeader           = "X-Gitea-Signature"
+	GogsSignatureHeader            = "X-Gogs-Signature"
+	BitbucketServerSignatureHeader = "X-Hub-Signature"
+)
+
+// checkGitLabToken compares the GitLab token of the request with the rule's
+// secrets in constant time.
+func (r MatchRule) checkGitLabToken(req *Request) (bool, error) {
+	token, ok := headerValue(req, GitLabTokenHeader)
+	if !ok {
+		return false, &SignatureError{Signature: "missing"}
+	}
+
+	return r.checkSecrets(req, func(secret string) (bool, error) {
+		if secret == "" {
+			return false, errors.New("signature validation secret can not be empty")
+		}
+
+		if !compare(token, secret) {
+			// The token is a secret itself, so it is never included
+			// in the error.
+			return false, &SignatureError{Signature: redact.Mask}
+		}
+
+		return true, nil
+	})
+}
+
+// checkGiteaSignature verifies the hex encoded HMAC-SHA256 signature sent
+// by Gitea, or by Gogs.
+func (r MatchRule) checkGiteaSignature(req *Request) (bool, error) {
+	return r.checkSignatureHeader(req, CheckPayloadSignature256, GiteaSignatureHeader, GogsSignatureHeader)
+}
+
+// checkBitbucketServerSignature verifies the "sha256=" prefixed HMAC-SHA256
+// signature sent by Bitbucket Server.
+func (r MatchRule) checkBitbucketServerSignature(req *Request) (bool, error) {
+	return r.checkSignatureHeader(req, CheckPayloadSignature256, BitbucketServerSignatureHeader)
+}
+
+// checkSignatureHeader verifies the signature in the first of the given
+// headers that is present in the request using check and the rule's secrets.
+func (r MatchRule) checkSignatureHeader(req *Request, check func(payload []byte, secret, signature string) (string, error), headers ...string) (bool, error) {
+	for _, h := range headers {
+		signature, ok := headerValue(req, h)
+		if !ok {
+			continue
+		}
+
+		return r.checkSecrets(req, func(secret string) (bool, error) {
+			_, err := check(req.Body, secret, signature)
+			return err == nil, err
+		})
+	}
+
+	return false, &SignatureError{Signature: "missing"}
+}
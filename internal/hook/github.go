@@ -0,0 +1,88 @@
+package hook
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// GitHub webhook headers.
+const (
+	GitHubSignatureHeader    = "X-Hub-Signature"
+	GitHubSignature256Header = "X-Hub-Signature-256"
+	GitHubDeliveryHeader     = "X-Github-Delivery"
+)
+
+// checkGitHubSignature verifies the GitHub signature of the request using
+// the rule's secrets. The SHA-256 signature is checked if it is present,
+// falling back to the SHA-1 signature sent by older GitHub versions. If the
+// rule sets a replay window, a delivery ID that was already verified within
+// the window is rejected.
+func (r MatchRule) checkGitHubSignature(req *Request) (bool, error) {
+	check := CheckPayloadSignature256
+
+	signature, ok := headerValue(req, GitHubSignature256Header)
+	if !ok {
+		check = CheckPayloadSignature
+
+		signature, ok = headerValue(req, GitHubSignatureHeader)
+		if !ok {
+			return false, &SignatureError{Signature: "missing"}
+		}
+	}
+
+	ok, err := r.checkSecrets(req, func(secret string) (bool, error) {
+		_, err := check(req.Body, secret, signature)
+		return err == nil, err
+	})
+	if !ok || err != nil || r.replayWindow == 0 {
+		return ok, err
+	}
+
+	id, _ := headerValue(req, GitHubDeliveryHeader)
+	if id == "" {
+		return false, &SignatureError{Signature: "missing delivery id"}
+	}
+
+	// The same delivery may be sent to several hooks.
+	key := req.HookID + "\x00" + id
+
+	if deliveries.Replayed(key, r.replayWindow, time.Now()) {
+		log.Printf("[%s] rejecting replayed GitHub delivery %s\n", req.ID, id)
+		return false, &SignatureError{Signature: "replayed"}
+	}
+
+	req.deliveries = append(req.deliveries, key)
+
+	return true, nil
+}
+
+// prepareReplayWindow parses the rule's replay window.
+func (r *MatchRule) prepareReplayWindow(c *configChecker, path string) {
+	if r.ReplayWindow == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(r.ReplayWindow)
+	if err == nil && d <= 0 {
+		err = errors.New("must be positive")
+	}
+	if err != nil {
+		c.add(path+".replay-window", err)
+		return
+	}
+
+	r.replayWindow = d
+}
+
+// headerValue returns the value of the named request header, or its first
+// value if it is repeated. It returns false if the header is missing.
+func headerValue(req *Request, name string) (string, bool) {
+	if req.Headers == nil {
+		return "", false
+	}
+
+	v, ok := firstValue(req.Headers[name]).(string)
+
+	return v, ok
+}
@@ -19,6 +19,7 @@ import (
 	"net"
 	"net/textproto"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -26,6 +27,8 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/adnanh/webhook/internal/redact"
+
 	"github.com/oliveagle/jsonpath"
 
 	"github.com/ghodss/yaml"
@@ -43,6 +46,15 @@ const (
 	SourceEntirePayload  string = "entire-payload"
 	SourceEntireQuery    string = "entire-query"
 	SourceEntireHeaders  string = "entire-headers"
+	SourceSecret         string = "secret"
+	SourceClaims         string = "claims"
+	SourceMultipartFile  string = "multipart-file"
+)
+
+// Constants used to specify the hook workspace mode
+const (
+	WorkspaceShared    string = ""
+	WorkspaceEphemeral string = "ephemeral"
 )
 
 const (
@@ -132,6 +144,41 @@ func (e *SourceError) Error() string {
 	return fmt.Sprintf("invalid source for argument %+v", e.Argument)
 }
 
+// ConfigError describes an invalid setting found while loading a hook.
+type ConfigError struct {
+	Hook string
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	if e.Hook == "" {
+		return fmt.Sprintf("%s: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("hook %q: %s: %v", e.Hook, e.Path, e.Err)
+}
+
+// LoadError collects the problems found while loading a hooks file.
+type LoadError struct {
+	Errors []error
+}
+
+func (e *LoadError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i := range e.Errors {
+		msgs[i] = e.Errors[i].Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
 // ParseError describes an error parsing user input.
 type ParseError struct {
 	Err error
@@ -236,24 +283,27 @@ func CheckPayloadSignature512(payload []byte, secret, signature string) (string,
 	return ValidateMAC(payload, hmac.New(sha512.New, []byte(secret)), signatures)
 }
 
-func checkScalrSignature(r *Request, signingKey string, checkDate bool) (bool, error) {
+// checkScalrSignature verifies the Scalr signature of the request. If
+// tolerance is not zero, a request dated more than tolerance away from the
+// current time is rejected.
+func checkScalrSignature(r *Request, signingKey string, tolerance time.Duration) (bool, error) {
 	if r.Headers == nil {
 		return false, nil
 	}
 
 	// Check for the signature and date headers
-	if _, ok := r.Headers["X-Signature"]; !ok {
+	providedSignature, ok := headerValue(r, "X-Signature")
+	if !ok {
 		return false, nil
 	}
-	if _, ok := r.Headers["Date"]; !ok {
+	dateHeader, ok := headerValue(r, "Date")
+	if !ok {
 		return false, nil
 	}
 	if signingKey == "" {
 		return false, errors.New("signature validation signing key can not be empty")
 	}
 
-	providedSignature := r.Headers["X-Signature"].(string)
-	dateHeader := r.Headers["Date"].(string)
 	mac := hmac.New(sha1.New, []byte(signingKey))
 	mac.Write(r.Body)
 	mac.Write([]byte(dateHeader))
@@ -263,7 +313,7 @@ func checkScalrSignature(r *Request, signingKey string, checkDate bool) (bool, e
 		return false, &SignatureError{Signature: providedSignature}
 	}
 
-	if !checkDate {
+	if tolerance == 0 {
 		return true, nil
 	}
 	// Example format: Fri 08 Sep 2017 11:24:32 UTC
@@ -274,7 +324,7 @@ func checkScalrSignature(r *Request, signingKey string, checkDate bool) (bool, e
 	now := time.Now()
 	delta := math.Abs(now.Sub(date).Seconds())
 
-	if delta > 300 {
+	if delta > tolerance.Seconds() {
 		return false, &SignatureError{Signature: "outdated"}
 	}
 	return true, nil
@@ -284,16 +334,7 @@ func checkScalrSignature(r *Request, signingKey string, checkDate bool) (bool, e
 // (in CIDR form or a single IP address).
 func CheckIPWhitelist(remoteAddr, ipRange string) (bool, error) {
 	// Extract IP address from remote address.
-
-	// IPv6 addresses will likely be surrounded by [].
-	ip := strings.Trim(remoteAddr, " []")
-
-	if i := strings.LastIndex(ip, ":"); i != -1 {
-		ip = ip[:i]
-		ip = strings.Trim(ip, " []")
-	}
-
-	parsedIP := net.ParseIP(ip)
+	parsedIP := parseRemoteAddr(remoteAddr)
 	if parsedIP == nil {
 		return false, fmt.Errorf("invalid IP address found in remote address '%s'", remoteAddr)
 	}
@@ -302,7 +343,11 @@ func CheckIPWhitelist(remoteAddr, ipRange string) (bool, error) {
 		// Extract IP range in CIDR form.  If a single IP address is provided, turn it into CIDR form.
 
 		if !strings.Contains(r, "/") {
-			r = r + "/32"
+			if ip := net.ParseIP(r); ip != nil && ip.To4() == nil {
+				r = r + "/128"
+			} else {
+				r = r + "/32"
+			}
 		}
 
 		_, cidr, err := net.ParseCIDR(r)
@@ -318,6 +363,21 @@ func CheckIPWhitelist(remoteAddr, ipRange string) (bool, error) {
 	return false, nil
 }
 
+// parseRemoteAddr parses the IP address of a remote address, which may
+// include a port.
+func parseRemoteAddr(remoteAddr string) net.IP {
+	// IPv6 addresses will likely be surrounded by [].
+	ip := strings.Trim(remoteAddr, " []")
+
+	// The address of a client behind a trusted proxy has no port.
+	if i := strings.LastIndex(ip, ":"); i != -1 && net.ParseIP(ip) == nil {
+		ip = ip[:i]
+		ip = strings.Trim(ip, " []")
+	}
+
+	return net.ParseIP(ip)
+}
+
 // ReplaceParameter replaces parameter value with the passed value in the passed map
 // (please note you should pass pointer to the map, because we're modifying it)
 // based on the passed string
@@ -393,17 +453,22 @@ func GetParameter(s string, params interface{}) (interface{}, error) {
 	case reflect.Map:
 		// Check for raw key
 		if v, ok := params.(map[string]interface{})[s]; ok {
-			return v, nil
+			return firstValue(v), nil
 		}
 
 		// Checked for dotted references
 		p := strings.SplitN(s, ".", 2)
 		if pValue, ok := params.(map[string]interface{})[p[0]]; ok {
 			if len(p) > 1 {
+				// The values of a repeated name are selected by index.
+				if rv, ok := pValue.(RepeatedValues); ok {
+					pValue = []interface{}(rv)
+				}
+
 				return GetParameter(p[1], pValue)
 			}
 
-			return pValue, nil
+			return firstValue(pValue), nil
 		}
 	}
 
@@ -426,6 +491,11 @@ func ExtractParameterAsString(s string, params interface{}, jpath string) (strin
 		return "", err
 	}
 
+	return parameterAsString(pValue)
+}
+
+// parameterAsString renders an extracted parameter value as a string.
+func parameterAsString(pValue interface{}) (string, error) {
 	switch v := reflect.ValueOf(pValue); v.Kind() {
 	case reflect.Array, reflect.Map, reflect.Slice:
 		r, err := json.Marshal(pValue)
@@ -441,23 +511,66 @@ func ExtractParameterAsString(s string, params interface{}, jpath string) (strin
 }
 
 func getParameterJPath(s string, params interface{}) (interface{}, error) {
-	//res, err := jsonpath.JsonPathLookup(params, "$.expensive")
+	pat, err := jsonpath.Compile(s)
+	if err != nil {
+		return nil, err
+	}
 
-	//or reuse lookup pattern
-	//pat, _ := jsonpath.Compile(`$.store.book[?(@.price < $.expensive)].price`)
-	pat, _ := jsonpath.Compile(s)
-	res, err := pat.Lookup(params)
-	return res, err
+	return pat.Lookup(params)
 }
 
 // Argument type specifies the parameter key name and the source it should
 // be extracted from
 type Argument struct {
-	Source       string `json:"source,omitempty"`
-	Name         string `json:"name,omitempty"`
-	EnvName      string `json:"envname,omitempty"`
-	Base64Decode bool   `json:"base64decode,omitempty"`
-	Expression   string `json:"expression,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	EnvName      string     `json:"envname,omitempty"`
+	Base64Decode bool       `json:"base64decode,omitempty"`
+	Expression   string     `json:"expression,omitempty"`
+	Sensitive    bool       `json:"sensitive,omitempty"`
+	Secret       *SecretRef `json:"secret,omitempty"`
+
+	// secret holds the resolved value of Secret. It is kept behind a pointer
+	// so that it is not printed when the argument is formatted.
+	secret *string
+
+	// jpath is Expression compiled when the hooks are loaded.
+	jpath *jsonpath.Compiled
+}
+
+// prepare compiles the argument's JSONPath expression and resolves its
+// secret reference, if any.
+func (ha *Argument) prepare(c *configChecker, path string) {
+	if ha.Expression != "" {
+		pat, err := jsonpath.Compile(ha.Expression)
+		if err != nil {
+			c.add(path+".expression", err)
+		}
+
+		ha.jpath = pat
+	}
+
+	if ha.Source != SourceSecret {
+		return
+	}
+
+	if ha.Secret == nil {
+		c.add(path, errors.New("missing secret reference"))
+		return
+	}
+
+	v, err := ha.Secret.Resolve()
+	if err != nil {
+		c.add(path+".secret", err)
+		return
+	}
+
+	ha.secret = &v
+}
+
+// IsSensitive returns true if the argument's value must not be logged.
+func (ha *Argument) IsSensitive() bool {
+	return ha.Sensitive || ha.Source == SourceSecret
 }
 
 // Get Argument method returns the value for the Argument's key name
@@ -477,12 +590,34 @@ func (ha *Argument) Get(r *Request) (string, error) {
 	case SourcePayload:
 		source = &r.Payload
 
+	case SourceClaims:
+		source = &r.Claims
+
 	case SourceString:
 		return ha.Name, nil
 
+	case SourceSecret:
+		if ha.secret != nil {
+			return *ha.secret, nil
+		}
+
+		if ha.Secret == nil {
+			return "", errors.New("missing secret reference")
+		}
+
+		return ha.Secret.Resolve()
+
 	case SourceRawRequestBody:
 		return string(r.Body), nil
 
+	case SourceMultipartFile:
+		f, prop, err := r.lookupFile(ha.Name)
+		if err != nil {
+			return "", err
+		}
+
+		return f.property(prop), nil
+
 	case SourceRequest:
 		if r == nil || r.RawRequest == nil {
 			return "", errors.New("request is nil")
@@ -490,7 +625,7 @@ func (ha *Argument) Get(r *Request) (string, error) {
 
 		switch strings.ToLower(ha.Name) {
 		case "remote-addr":
-			return r.RawRequest.RemoteAddr, nil
+			return r.ClientAddr(), nil
 		case "method":
 			return r.RawRequest.Method, nil
 		default:
@@ -523,12 +658,33 @@ func (ha *Argument) Get(r *Request) (string, error) {
 	}
 
 	if source != nil {
+		if ha.jpath != nil {
+			v, err := ha.jpath.Lookup(*source)
+			if err != nil {
+				return "", err
+			}
+
+			return parameterAsString(firstValue(v))
+		}
+
 		return ExtractParameterAsString(key, *source, ha.Expression)
 	}
 
 	return "", errors.New("no source for value retrieval")
 }
 
+// envName returns the name of the environment variable the argument is
+// passed to the command as.
+func (ha *Argument) envName() string {
+	if ha.EnvName != "" {
+		// first try to use the EnvName if specified
+		return ha.EnvName
+	}
+
+	// then fallback on the name
+	return EnvNamespace + ha.Name
+}
+
 // Header is a structure containing header name and it's value
 type Header struct {
 	Name  string `json:"name"`
@@ -587,7 +743,13 @@ type Hook struct {
 	ID                                  string          `json:"id,omitempty"`
 	ExecuteCommand                      string          `json:"execute-command,omitempty"`
 	CommandWorkingDirectory             string          `json:"command-working-directory,omitempty"`
+	Workspace                           string          `json:"workspace,omitempty"`
+	WorkspaceTemplate                   string          `json:"workspace-template,omitempty"`
+	KeepWorkspaceOnFailure              bool            `json:"keep-workspace-on-failure,omitempty"`
 	ResponseMessage                     string          `json:"response-message,omitempty"`
+	ResponseMessageAsTemplate           bool            `json:"response-message-as-template,omitempty"`
+	ResponseTemplateFile                string          `json:"response-template-file,omitempty"`
+	ResponseContentType                 string          `json:"response-content-type,omitempty"`
 	ResponseHeaders                     ResponseHeaders `json:"response-headers,omitempty"`
 	CaptureCommandOutput                bool            `json:"include-command-output-in-response,omitempty"`
 	CaptureCommandOutputOnError         bool            `json:"include-command-output-in-response-on-error,omitempty"`
@@ -601,6 +763,173 @@ type Hook struct {
 	IncomingPayloadContentType          string          `json:"incoming-payload-content-type,omitempty"`
 	SuccessHTTPResponseCode             int             `json:"success-http-response-code,omitempty"`
 	HTTPMethods                         []string        `json:"http-methods"`
+	Auth                                *Auth           `json:"auth,omitempty"`
+	DebugRules                          bool            `json:"debug-rules,omitempty"`
+	TimeWindowMismatchHTTPResponseCode  int             `json:"time-window-mismatch-http-response-code,omitempty"`
+	RateLimit                           *RateLimit      `json:"rate-limit,omitempty"`
+	IdempotencyKey                      *IdempotencyKey `json:"idempotency-key,omitempty"`
+	MaxMultipartFiles                   int             `json:"max-multipart-files,omitempty"`
+	MaxMultipartFileSize                int64           `json:"max-multipart-file-size,omitempty"`
+	MaxBodySize                         int64           `json:"max-body-size,omitempty"`
+
+	responseTemplate *template.Template
+}
+
+// ResponseData is the data passed to a hook's response template.
+type ResponseData struct {
+	// ID is the hook ID.
+	ID string
+
+	// Request is the incoming request that triggered the hook.
+	Request *Request
+
+	// Output is the combined output of the command. It is only set for hooks
+	// that include the command output in the response.
+	Output string
+
+	// ExitCode is the exit code of the command. It is only set for hooks
+	// that include the command output in the response.
+	ExitCode int
+}
+
+// HasResponseTemplate returns true if the hook's response should be rendered
+// as a template.
+func (h *Hook) HasResponseTemplate() bool {
+	return h.ResponseMessageAsTemplate || h.ResponseTemplateFile != ""
+}
+
+// RenderResponse renders the hook's response template with the given data.
+func (h *Hook) RenderResponse(d *ResponseData) (string, error) {
+	tmpl := h.responseTemplate
+	if tmpl == nil {
+		var err error
+
+		tmpl, err = h.parseResponseTemplate()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+
+	err := tmpl.Execute(&buf, d)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// parseResponseTemplate parses the response template from the
+// ResponseTemplateFile, if set, or else the ResponseMessage.
+func (h *Hook) parseResponseTemplate() (*template.Template, error) {
+	text := h.ResponseMessage
+
+	if h.ResponseTemplateFile != "" {
+		b, err := ioutil.ReadFile(h.ResponseTemplateFile)
+		if err != nil {
+			return nil, err
+		}
+
+		text = string(b)
+	}
+
+	funcMap := template.FuncMap{"json": toJSON}
+
+	return template.New(h.ID).Funcs(funcMap).Parse(text)
+}
+
+// prepare readies the hook for serving requests and returns any problems
+// found with its configuration.
+func (h *Hook) prepare(s *shared) []error {
+	c := &configChecker{hook: h.ID, shared: s}
+
+	if h.HasResponseTemplate() {
+		tmpl, err := h.parseResponseTemplate()
+		if err != nil {
+			path := "response-message"
+			if h.ResponseTemplateFile != "" {
+				path = "response-template-file"
+			}
+
+			c.add(path, err)
+		}
+
+		h.responseTemplate = tmpl
+	}
+
+	switch h.Workspace {
+	case WorkspaceShared:
+	case WorkspaceEphemeral:
+		if h.WorkspaceTemplate != "" {
+			fi, err := os.Stat(h.WorkspaceTemplate)
+			if err == nil && !fi.IsDir() {
+				err = fmt.Errorf("%s is not a directory", h.WorkspaceTemplate)
+			}
+
+			if err != nil {
+				c.add("workspace-template", err)
+			}
+		}
+	default:
+		c.add("workspace", fmt.Errorf("unsupported workspace mode %q", h.Workspace))
+	}
+
+	if h.Auth != nil {
+		h.Auth.prepare(c, "auth")
+	}
+
+	if h.RateLimit != nil {
+		h.RateLimit.prepare(c, "rate-limit")
+	}
+
+	if h.IdempotencyKey != nil {
+		h.IdempotencyKey.prepare(c, "idempotency-key")
+	}
+
+	if h.MaxMultipartFiles < 0 {
+		c.add("max-multipart-files", errors.New("must not be negative"))
+	}
+
+	if h.MaxMultipartFileSize < 0 {
+		c.add("max-multipart-file-size", errors.New("must not be negative"))
+	}
+
+	if h.MaxBodySize < -1 {
+		c.add("max-body-size", errors.New("must be -1 or more"))
+	}
+
+	for _, args := range []struct {
+		path string
+		args []Argument
+	}{
+		{"pass-arguments-to-command", h.PassArgumentsToCommand},
+		{"pass-environment-to-command", h.PassEnvironmentToCommand},
+		{"pass-file-to-command", h.PassFileToCommand},
+		{"parse-parameters-as-json", h.JSONStringParameters},
+	} {
+		for i := range args.args {
+			args.args[i].prepare(c, fmt.Sprintf("%s[%d]", args.path, i))
+		}
+	}
+
+	if h.TriggerRule != nil {
+		h.TriggerRule.prepare(c, "trigger-rule")
+	}
+
+	return c.errs
+}
+
+// configChecker collects the problems found while preparing a hook.
+type configChecker struct {
+	hook   string
+	shared *shared
+	errs   []error
+}
+
+// add records a problem with the setting at path.
+func (c *configChecker) add(path string, err error) {
+	c.errs = append(c.errs, &ConfigError{Hook: c.hook, Path: path, Err: err})
 }
 
 // ParseJSONParameters decodes specified arguments to JSON objects and replaces the
@@ -695,13 +1024,7 @@ func (h *Hook) ExtractCommandArgumentsForEnv(r *Request) ([]string, []error) {
 			continue
 		}
 
-		if h.PassEnvironmentToCommand[i].EnvName != "" {
-			// first try to use the EnvName if specified
-			args = append(args, h.PassEnvironmentToCommand[i].EnvName+"="+arg)
-		} else {
-			// then fallback on the name
-			args = append(args, EnvNamespace+h.PassEnvironmentToCommand[i].Name+"="+arg)
-		}
+		args = append(args, h.PassEnvironmentToCommand[i].envName()+"="+arg)
 	}
 
 	if len(errors) > 0 {
@@ -711,11 +1034,52 @@ func (h *Hook) ExtractCommandArgumentsForEnv(r *Request) ([]string, []error) {
 	return args, nil
 }
 
+// RedactedCommandArguments returns the command arguments, as created by
+// ExtractCommandArguments, with sensitive values masked so they can be
+// logged.
+func (h *Hook) RedactedCommandArguments(r *Request) []string {
+	args, _ := h.ExtractCommandArguments(r.Redacted())
+
+	for i := range h.PassArgumentsToCommand {
+		if h.PassArgumentsToCommand[i].IsSensitive() {
+			args[i+1] = redact.Mask
+		}
+	}
+
+	return args
+}
+
+// RedactedCommandArgumentsForEnv returns the command environment, as created
+// by ExtractCommandArgumentsForEnv, with sensitive values masked so they can
+// be logged.
+func (h *Hook) RedactedCommandArgumentsForEnv(r *Request) []string {
+	args, _ := h.ExtractCommandArgumentsForEnv(r.Redacted())
+
+	for i := range h.PassEnvironmentToCommand {
+		if !h.PassEnvironmentToCommand[i].IsSensitive() {
+			continue
+		}
+
+		prefix := h.PassEnvironmentToCommand[i].envName() + "="
+		for j := range args {
+			if strings.HasPrefix(args[j], prefix) {
+				args[j] = prefix + redact.Mask
+			}
+		}
+	}
+
+	return args
+}
+
 // FileParameter describes a pass-file-to-command instance to be stored as file
 type FileParameter struct {
 	File    *os.File
 	EnvName string
 	Data    []byte
+
+	// Path is the path of a file already on disk, such as an uploaded
+	// file, which is passed to the command instead of storing Data.
+	Path string
 }
 
 // ExtractCommandArgumentsForFile creates a list of arguments in key=value
@@ -737,6 +1101,14 @@ func (h *Hook) ExtractCommandArgumentsForFile(r *Request) ([]FileParameter, []er
 			h.PassFileToCommand[i].EnvName = EnvNamespace + strings.ToUpper(h.PassFileToCommand[i].Name)
 		}
 
+		// Uploaded files are passed as they are saved.
+		if h.PassFileToCommand[i].Source == SourceMultipartFile {
+			if f, prop, _ := r.lookupFile(h.PassFileToCommand[i].Name); prop == FilePropertyPath {
+				args = append(args, FileParameter{EnvName: h.PassFileToCommand[i].EnvName, Path: f.Path})
+				continue
+			}
+		}
+
 		var fileContent []byte
 		if h.PassFileToCommand[i].Base64Decode {
 			dec, err := base64.StdEncoding.DecodeString(arg)
@@ -765,36 +1137,171 @@ type Hooks []Hook
 // can be either JSON or YAML.  The asTemplate parameter causes the file
 // contents to be parsed as a Go text/template prior to unmarshalling.
 func (h *Hooks) LoadFromFile(path string, asTemplate bool) error {
+	_, err := h.LoadFromFileWithRulesFile(path, asTemplate)
+	return err
+}
+
+// LoadFromFileWithRulesFile loads hooks like LoadFromFile, and also returns
+// the path of the rules file named by the hooks file, if any, so that it can
+// be watched for changes. The path is returned even if loading fails.
+func (h *Hooks) LoadFromFileWithRulesFile(path string, asTemplate bool) (string, error) {
 	if path == "" {
-		return nil
+		return "", nil
 	}
 
 	// parse hook file for hooks
-	file, e := ioutil.ReadFile(path)
-
-	if e != nil {
-		return e
+	file, err := readConfigFile(path, asTemplate)
+	if err != nil {
+		return "", err
 	}
 
-	if asTemplate {
-		funcMap := template.FuncMap{"getenv": getenv}
+	j, err := yaml.YAMLToJSON(file)
+	if err != nil {
+		return "", err
+	}
 
-		tmpl, err := template.New("hooks").Funcs(funcMap).Parse(string(file))
+	// A hooks file is either a list of hooks or an object that also holds
+	// the definitions shared by its hooks.
+	if j = bytes.TrimSpace(j); len(j) == 0 || j[0] != '{' {
+		err = yaml.Unmarshal(file, h)
 		if err != nil {
-			return err
+			return "", err
 		}
 
-		var buf bytes.Buffer
+		return "", h.prepare(&shared{})
+	}
+
+	var f hooksFile
+
+	err = yaml.Unmarshal(file, &f)
+	if err != nil {
+		return "", err
+	}
+
+	var rulesPath string
 
-		err = tmpl.Execute(&buf, nil)
+	if f.RulesFile != "" {
+		rulesPath = f.RulesFile
+		if !filepath.IsAbs(rulesPath) {
+			rulesPath = filepath.Join(filepath.Dir(path), rulesPath)
+		}
+
+		rules, err := loadRulesFile(rulesPath, asTemplate)
 		if err != nil {
-			return err
+			return rulesPath, fmt.Errorf("error loading rules file %s: %w", rulesPath, err)
+		}
+
+		if f.Rules == nil {
+			f.Rules = make(map[string]*Rules, len(rules))
+		}
+
+		for name, r := range rules {
+			if _, ok := f.Rules[name]; ok {
+				return rulesPath, fmt.Errorf("rule %q is defined in both the hooks file and %s", name, rulesPath)
+			}
+
+			f.Rules[name] = r
+		}
+	}
+
+	*h = f.Hooks
+
+	return rulesPath, h.prepare(&shared{ipSets: f.IPSets, rules: f.Rules})
+}
+
+// readConfigFile reads the file at path, executing it as a Go template if
+// asTemplate is set.
+func readConfigFile(path string, asTemplate bool) ([]byte, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !asTemplate {
+		return file, nil
+	}
+
+	funcMap := template.FuncMap{"getenv": getenv}
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(funcMap).Parse(string(file))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	err = tmpl.Execute(&buf, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// loadRulesFile loads a file of named rules.
+func loadRulesFile(path string, asTemplate bool) (map[string]*Rules, error) {
+	file, err := readConfigFile(path, asTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules map[string]*Rules
+
+	err = yaml.Unmarshal(file, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// hooksFile is the object form of a hooks file.
+type hooksFile struct {
+	Hooks  Hooks             `json:"hooks"`
+	IPSets map[string]*IPSet `json:"ip-sets,omitempty"`
+
+	// Rules holds named rules that trigger rules reference with
+	// {"ref": "name"}.
+	Rules map[string]*Rules `json:"rules,omitempty"`
+
+	// RulesFile is the path to a file of named rules, relative to the
+	// hooks file.
+	RulesFile string `json:"rules-file,omitempty"`
+}
+
+// shared holds the definitions shared by the hooks of a hooks file.
+type shared struct {
+	ipSets map[string]*IPSet
+	rules  map[string]*Rules
+}
+
+// prepare readies all hooks for serving requests and returns a LoadError
+// describing any problems found.
+func (h *Hooks) prepare(s *shared) error {
+	var errs []error
+
+	c := &configChecker{shared: s}
+	for name, set := range s.ipSets {
+		if set == nil {
+			c.add("ip-sets."+name, errors.New("empty IP set"))
+			continue
 		}
 
-		file = buf.Bytes()
+		set.prepare(c, "ip-sets."+name)
 	}
 
-	return yaml.Unmarshal(file, h)
+	s.prepareRules(c)
+	errs = append(errs, c.errs...)
+
+	for i := range *h {
+		errs = append(errs, (*h)[i].prepare(s)...)
+	}
+
+	if len(errs) > 0 {
+		return &LoadError{Errors: errs}
+	}
+
+	return nil
 }
 
 // Append appends hooks unless the new hooks contain a hook with an ID that already exists
@@ -828,11 +1335,30 @@ type Rules struct {
 	Or    *OrRule    `json:"or,omitempty"`
 	Not   *NotRule   `json:"not,omitempty"`
 	Match *MatchRule `json:"match,omitempty"`
+
+	Expression *Expression `json:"expression,omitempty"`
+
+	// Ref names a rule defined in the rules section of the hooks file.
+	Ref string `json:"ref,omitempty"`
+
+	ref *Rules
 }
 
 // Evaluate finds the first rule property that is not nil and returns the value
 // it evaluates to
 func (r Rules) Evaluate(req *Request) (bool, error) {
+	if req.trace != nil {
+		return r.evaluateTraced(req)
+	}
+
+	return r.evaluate(req)
+}
+
+func (r Rules) evaluate(req *Request) (bool, error) {
+	// A rule that does not match only leaves TimeWindowMismatch set if it
+	// would have matched had its time windows been open.
+	req.TimeWindowMismatch = ""
+
 	switch {
 	case r.And != nil:
 		return r.And.Evaluate(req)
@@ -842,17 +1368,56 @@ func (r Rules) Evaluate(req *Request) (bool, error) {
 		return r.Not.Evaluate(req)
 	case r.Match != nil:
 		return r.Match.Evaluate(req)
+	case r.Expression != nil:
+		return r.Expression.Evaluate(req)
+	case r.Ref != "":
+		if r.ref == nil {
+			return false, fmt.Errorf("undefined rule %q", r.Ref)
+		}
+
+		return r.ref.Evaluate(req)
 	}
 
 	return false, nil
 }
 
+// prepare readies the rule tree for evaluation, reporting problems with the
+// rule at path.
+func (r *Rules) prepare(c *configChecker, path string) {
+	switch {
+	case r.And != nil:
+		for i := range *r.And {
+			(*r.And)[i].prepare(c, fmt.Sprintf("%s.and[%d]", path, i))
+		}
+	case r.Or != nil:
+		for i := range *r.Or {
+			(*r.Or)[i].prepare(c, fmt.Sprintf("%s.or[%d]", path, i))
+		}
+	case r.Not != nil:
+		(*Rules)(r.Not).prepare(c, path+".not")
+	case r.Match != nil:
+		r.Match.prepare(c, path+".match")
+	case r.Expression != nil:
+		if err := r.Expression.compile(); err != nil {
+			c.add(path+".expression", err)
+		}
+	case r.Ref != "":
+		if c.shared != nil {
+			r.ref = c.shared.rules[r.Ref]
+		}
+
+		if r.ref == nil {
+			c.add(path+".ref", fmt.Errorf("undefined rule %q", r.Ref))
+		}
+	}
+}
+
 // AndRule will evaluate to true if and only if all of the ChildRules evaluate to true
 type AndRule []Rules
 
 // Evaluate AndRule will return true if and only if all of ChildRules evaluate to true
 func (r AndRule) Evaluate(req *Request) (bool, error) {
-	res := true
+	var mismatch string
 
 	for _, v := range r {
 		rv, err := v.Evaluate(req)
@@ -860,13 +1425,24 @@ func (r AndRule) Evaluate(req *Request) (bool, error) {
 			return false, err
 		}
 
-		res = res && rv
-		if !res {
-			return res, nil
+		if rv {
+			continue
+		}
+
+		// After a closed time window, keep going to tell whether it is the
+		// only reason the rule does not match.
+		if req.TimeWindowMismatch == "" {
+			return false, nil
+		}
+
+		if mismatch == "" {
+			mismatch = req.TimeWindowMismatch
 		}
 	}
 
-	return res, nil
+	req.TimeWindowMismatch = mismatch
+
+	return mismatch == "", nil
 }
 
 // OrRule will evaluate to true if any of the ChildRules evaluate to true
@@ -874,6 +1450,8 @@ type OrRule []Rules
 
 // Evaluate OrRule will return true if any of ChildRules evaluate to true
 func (r OrRule) Evaluate(req *Request) (bool, error) {
+	var mismatch string
+
 	res := false
 
 	for _, v := range r {
@@ -890,8 +1468,14 @@ func (r OrRule) Evaluate(req *Request) (bool, error) {
 		if res {
 			return res, nil
 		}
+
+		if mismatch == "" {
+			mismatch = req.TimeWindowMismatch
+		}
 	}
 
+	req.TimeWindowMismatch = mismatch
+
 	return res, nil
 }
 
@@ -901,6 +1485,8 @@ type NotRule Rules
 // Evaluate NotRule will return true if and only if ChildRule evaluates to false
 func (r NotRule) Evaluate(req *Request) (bool, error) {
 	rv, err := Rules(r).Evaluate(req)
+	req.TimeWindowMismatch = ""
+
 	return !rv, err
 }
 
@@ -912,29 +1498,318 @@ type MatchRule struct {
 	Value     string   `json:"value,omitempty"`
 	Parameter Argument `json:"parameter,omitempty"`
 	IPRange   string   `json:"ip-range,omitempty"`
+	IPSet     string   `json:"ip-set,omitempty"`
+	Values    []string `json:"values,omitempty"`
+
+	// SecretRef references the secret stored outside the hooks file. It is
+	// set when the secret is given as an object instead of a string and is
+	// resolved into Secret when the hooks are loaded.
+	SecretRef *SecretRef `json:"-"`
+
+	// Secrets lists the secrets accepted by a signature rule in place of
+	// Secret. The rule matches if the signature is valid for any of the
+	// secrets that have not expired.
+	Secrets []RuleSecret `json:"secrets,omitempty"`
+
+	// ReplayWindow is the duration for which the delivery ID of a verified
+	// github-signature request is remembered and a repeated delivery is
+	// rejected.
+	ReplayWindow string `json:"replay-window,omitempty"`
+
+	replayWindow time.Duration
+
+	// TimestampedHMAC configures the timestamped-hmac match type, and
+	// overrides the defaults of the stripe-signature and slack-signature
+	// match types.
+	TimestampedHMAC *TimestampedHMAC `json:"timestamped-hmac,omitempty"`
+
+	// Tolerance is the maximum age of a timestamped signature. It defaults
+	// to DefaultSignatureTolerance.
+	Tolerance string `json:"tolerance,omitempty"`
+
+	tolerance time.Duration
+
+	ipSets []*IPSet
+
+	// regex is Regex compiled when the hooks are loaded.
+	regex *regexp.Regexp
+
+	// PublicKey configures the public-key-signature match type.
+	PublicKey *PublicKey `json:"public-key,omitempty"`
+
+	// JWT configures the jwt match type.
+	JWT *JWT `json:"jwt,omitempty"`
+
+	// TimeWindow configures the time-window match type.
+	TimeWindow *TimeWindow `json:"time-window,omitempty"`
+
+	// SignedBody is the body a signature is verified over if the request
+	// body was compressed: the body as received (SignedBodyRaw, the
+	// default) or the decoded body (SignedBodyDecoded).
+	SignedBody string `json:"signed-body,omitempty"`
+}
+
+// Constants for the MatchRule signed body
+const (
+	SignedBodyRaw     string = "raw"
+	SignedBodyDecoded string = "decoded"
+)
+
+// UnmarshalJSON unmarshals a MatchRule, accepting the secret either as a
+// literal string or as a SecretRef object.
+func (r *MatchRule) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return err
+	}
+
+	secret := fields["secret"]
+	delete(fields, "secret")
+
+	b, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	// Unmarshal the remaining fields with the YAML unmarshaller so that
+	// scalar values, such as numbers, are converted to strings as they are
+	// for the rest of the hooks file.
+	type matchRule MatchRule
+
+	err = yaml.Unmarshal(b, (*matchRule)(r))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(secret) == 0 || string(secret) == "null":
+		return nil
+
+	case secret[0] == '{':
+		r.SecretRef = new(SecretRef)
+		return json.Unmarshal(secret, r.SecretRef)
+
+	case secret[0] == '"':
+		return json.Unmarshal(secret, &r.Secret)
+
+	default:
+		// Convert scalars, such as numbers, to strings as above.
+		return yaml.Unmarshal(secret, &r.Secret)
+	}
+}
+
+// prepare resolves the rule's secret references.
+func (r *MatchRule) prepare(c *configChecker, path string) {
+	if r.SecretRef != nil {
+		v, err := r.SecretRef.Resolve()
+		if err != nil {
+			c.add(path+".secret", err)
+		}
+
+		r.Secret = v
+	}
+
+	if len(r.Secrets) > 0 && (r.Secret != "" || r.SecretRef != nil) {
+		c.add(path, errors.New("only one of secret or secrets may be set"))
+	}
+
+	for i := range r.Secrets {
+		p := fmt.Sprintf("%s.secrets[%d]", path, i)
+
+		r.Secrets[i].prepare(c, p)
+
+		if r.Secrets[i].Value == "" && r.Secrets[i].File == "" && r.Secrets[i].Env == "" {
+			c.add(p, errors.New("secret is empty"))
+		}
+	}
+
+	r.prepareReplayWindow(c, path)
+
+	r.ipSets = nil
+	for _, name := range strings.Fields(r.IPSet) {
+		var set *IPSet
+		if c.shared != nil {
+			set = c.shared.ipSets[name]
+		}
+
+		if set == nil {
+			c.add(path+".ip-set", fmt.Errorf("undefined IP set %q", name))
+			continue
+		}
+
+		r.ipSets = append(r.ipSets, set)
+	}
+
+	if r.Tolerance != "" {
+		d, err := time.ParseDuration(r.Tolerance)
+		if err == nil && d <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			c.add(path+".tolerance", err)
+		}
+
+		r.tolerance = d
+	}
+
+	// Keep signatures read from custom headers out of debug dumps.
+	if r.verifiesBody() && r.Parameter.Source == SourceHeader && r.Parameter.Name != "" {
+		redact.AddHeaders(r.Parameter.Name)
+	}
+
+	switch r.Type {
+	case TimestampedHMACSignature, StripeSignature, SlackSignature:
+		if r.TimestampedHMAC == nil {
+			r.TimestampedHMAC = new(TimestampedHMAC)
+		}
+
+		r.TimestampedHMAC.prepare(c, path+".timestamped-hmac", r.Type)
+
+	case PublicKeySignature:
+		if r.PublicKey == nil {
+			c.add(path+".public-key", errors.New("missing public key"))
+			break
+		}
+
+		r.PublicKey.prepare(c, path+".public-key")
+
+	case MatchJWT:
+		if r.JWT == nil {
+			r.JWT = new(JWT)
+		}
+
+		r.JWT.prepare(c, path+".jwt", r.Secret != "" || r.SecretRef != nil || len(r.Secrets) > 0)
+
+	case MatchGreaterThan, MatchGreaterOrEqual, MatchLessThan, MatchLessOrEqual:
+		if _, err := strconv.ParseFloat(r.Value, 64); err != nil {
+			c.add(path+".value", fmt.Errorf("%q is not a number", r.Value))
+		}
+
+	case MatchIn, MatchNotIn:
+		if len(r.Values) == 0 {
+			c.add(path+".values", errors.New("missing values"))
+		}
+
+	case MatchTimeWindow:
+		if r.TimeWindow == nil {
+			c.add(path+".time-window", errors.New("missing time window"))
+			break
+		}
+
+		r.TimeWindow.prepare(c, path+".time-window")
+
+	case MatchRegex:
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			c.add(path+".regex", err)
+		}
+
+		r.regex = re
+	}
+
+	switch r.SignedBody {
+	case "", SignedBodyRaw, SignedBodyDecoded:
+	default:
+		c.add(path+".signed-body", fmt.Errorf("unsupported signed body %q; use raw or decoded", r.SignedBody))
+	}
+
+	r.Parameter.prepare(c, path+".parameter")
 }
 
 // Constants for the MatchRule type
 const (
-	MatchValue      string = "value"
-	MatchRegex      string = "regex"
-	MatchHMACSHA1   string = "payload-hmac-sha1"
-	MatchHMACSHA256 string = "payload-hmac-sha256"
-	MatchHMACSHA512 string = "payload-hmac-sha512"
-	MatchHashSHA1   string = "payload-hash-sha1"
-	MatchHashSHA256 string = "payload-hash-sha256"
-	MatchHashSHA512 string = "payload-hash-sha512"
-	IPWhitelist     string = "ip-whitelist"
-	ScalrSignature  string = "scalr-signature"
+	MatchValue               string = "value"
+	MatchRegex               string = "regex"
+	MatchHMACSHA1            string = "payload-hmac-sha1"
+	MatchHMACSHA256          string = "payload-hmac-sha256"
+	MatchHMACSHA512          string = "payload-hmac-sha512"
+	MatchHashSHA1            string = "payload-hash-sha1"
+	MatchHashSHA256          string = "payload-hash-sha256"
+	MatchHashSHA512          string = "payload-hash-sha512"
+	IPWhitelist              string = "ip-whitelist"
+	ScalrSignature           string = "scalr-signature"
+	GitHubSignature          string = "github-signature"
+	GitLabToken              string = "gitlab-token"
+	GiteaSignature           string = "gitea-signature"
+	BitbucketServerSignature string = "bitbucket-server-signature"
+	TimestampedHMACSignature string = "timestamped-hmac"
+	StripeSignature          string = "stripe-signature"
+	SlackSignature           string = "slack-signature"
+	PublicKeySignature       string = "public-key-signature"
+	MatchJWT                 string = "jwt"
+	MatchGreaterThan         string = "gt"
+	MatchGreaterOrEqual      string = "ge"
+	MatchLessThan            string = "lt"
+	MatchLessOrEqual         string = "le"
+	MatchIn                  string = "in"
+	MatchNotIn               string = "not-in"
+	MatchContains            string = "contains"
+	MatchPrefix              string = "prefix"
+	MatchSuffix              string = "suffix"
+	MatchExists              string = "exists"
+	MatchTimeWindow          string = "time-window"
 )
 
+// verifiesBody returns true if the rule verifies a signature over the request
+// body.
+func (r MatchRule) verifiesBody() bool {
+	switch r.Type {
+	case MatchHMACSHA1, MatchHMACSHA256, MatchHMACSHA512,
+		MatchHashSHA1, MatchHashSHA256, MatchHashSHA512,
+		ScalrSignature, GitHubSignature, GiteaSignature, BitbucketServerSignature,
+		TimestampedHMACSignature, StripeSignature, SlackSignature, PublicKeySignature:
+		return true
+	}
+
+	return false
+}
+
 // Evaluate MatchRule will return based on the type
 func (r MatchRule) Evaluate(req *Request) (bool, error) {
+	// Verify signatures over the body as received, unless the rule asks
+	// for the decoded body.
+	if req.RawBody != nil && r.SignedBody != SignedBodyDecoded && r.verifiesBody() {
+		body := req.Body
+		req.Body = req.RawBody
+		defer func() { req.Body = body }()
+	}
+
 	if r.Type == IPWhitelist {
-		return CheckIPWhitelist(req.RawRequest.RemoteAddr, r.IPRange)
+		return r.checkIPWhitelist(req)
 	}
 	if r.Type == ScalrSignature {
-		return checkScalrSignature(req, r.Secret, true)
+		return r.checkSecrets(req, func(secret string) (bool, error) {
+			return checkScalrSignature(req, secret, r.signatureTolerance())
+		})
+	}
+	switch r.Type {
+	case GitHubSignature:
+		return r.checkGitHubSignature(req)
+	case GitLabToken:
+		return r.checkGitLabToken(req)
+	case GiteaSignature:
+		return r.checkGiteaSignature(req)
+	case BitbucketServerSignature:
+		return r.checkBitbucketServerSignature(req)
+	case MatchJWT:
+		return r.checkJWT(req)
+	case MatchTimeWindow:
+		return r.checkTimeWindow(req)
+	case TimestampedHMACSignature, StripeSignature, SlackSignature:
+		if r.TimestampedHMAC == nil {
+			return false, errors.New("timestamped signature is not configured")
+		}
+
+		return r.checkSecrets(req, func(secret string) (bool, error) {
+			return r.TimestampedHMAC.check(req, secret, r.signatureTolerance())
+		})
+	}
+
+	if r.Type == MatchExists {
+		_, err := r.Parameter.Get(req)
+		return err == nil, nil
 	}
 
 	arg, err := r.Parameter.Get(req)
@@ -942,31 +1817,179 @@ func (r MatchRule) Evaluate(req *Request) (bool, error) {
 		switch r.Type {
 		case MatchValue:
 			return compare(arg, r.Value), nil
+		case MatchGreaterThan, MatchGreaterOrEqual, MatchLessThan, MatchLessOrEqual:
+			return compareNumbers(r.Type, arg, r.Value), nil
+		case MatchIn:
+			return inValues(arg, r.Values), nil
+		case MatchNotIn:
+			return !inValues(arg, r.Values), nil
+		case MatchContains:
+			return containsValue(arg, r.Value), nil
+		case MatchPrefix:
+			return strings.HasPrefix(arg, r.Value), nil
+		case MatchSuffix:
+			return strings.HasSuffix(arg, r.Value), nil
 		case MatchRegex:
+			if r.regex != nil {
+				return r.regex.MatchString(arg), nil
+			}
+
 			return regexp.MatchString(r.Regex, arg)
 		case MatchHashSHA1:
 			log.Print(`warn: use of deprecated option payload-hash-sha1; use payload-hmac-sha1 instead`)
 			fallthrough
 		case MatchHMACSHA1:
-			_, err := CheckPayloadSignature(req.Body, r.Secret, arg)
-			return err == nil, err
+			return r.checkSecrets(req, func(secret string) (bool, error) {
+				_, err := CheckPayloadSignature(req.Body, secret, arg)
+				return err == nil, err
+			})
 		case MatchHashSHA256:
 			log.Print(`warn: use of deprecated option payload-hash-sha256: use payload-hmac-sha256 instead`)
 			fallthrough
 		case MatchHMACSHA256:
-			_, err := CheckPayloadSignature256(req.Body, r.Secret, arg)
-			return err == nil, err
+			return r.checkSecrets(req, func(secret string) (bool, error) {
+				_, err := CheckPayloadSignature256(req.Body, secret, arg)
+				return err == nil, err
+			})
 		case MatchHashSHA512:
 			log.Print(`warn: use of deprecated option payload-hash-sha512: use payload-hmac-sha512 instead`)
 			fallthrough
 		case MatchHMACSHA512:
-			_, err := CheckPayloadSignature512(req.Body, r.Secret, arg)
-			return err == nil, err
+			return r.checkSecrets(req, func(secret string) (bool, error) {
+				_, err := CheckPayloadSignature512(req.Body, secret, arg)
+				return err == nil, err
+			})
+		case PublicKeySignature:
+			if r.PublicKey == nil {
+				return false, errors.New("public key is not configured")
+			}
+
+			return r.PublicKey.check(req, arg)
 		}
 	}
 	return false, err
 }
 
+// checkIPWhitelist checks whether the client address of the request is in
+// the rule's IP range or in any of its IP sets.
+func (r MatchRule) checkIPWhitelist(req *Request) (bool, error) {
+	if r.IPSet != "" {
+		if len(r.ipSets) == 0 {
+			return false, fmt.Errorf("IP sets %q are not loaded", r.IPSet)
+		}
+
+		ip := parseRemoteAddr(req.ClientAddr())
+		if ip == nil {
+			return false, fmt.Errorf("invalid IP address found in remote address '%s'", req.ClientAddr())
+		}
+
+		for _, set := range r.ipSets {
+			if set.Contains(ip) {
+				return true, nil
+			}
+		}
+
+		if r.IPRange == "" {
+			return false, nil
+		}
+	}
+
+	return CheckIPWhitelist(req.ClientAddr(), r.IPRange)
+}
+
+// checkJWT validates the JSON Web Token referenced by the rule's parameter,
+// by default the bearer token in the Authorization header. The claims of a
+// valid token are stored in the request.
+func (r MatchRule) checkJWT(req *Request) (bool, error) {
+	if r.JWT == nil {
+		return false, errors.New("jwt is not configured")
+	}
+
+	param := r.Parameter
+	if param.Source == "" {
+		param = Argument{Source: SourceHeader, Name: "Authorization"}
+	}
+
+	token, err := param.Get(req)
+	if err != nil || token == "" {
+		return false, tokenError("missing")
+	}
+
+	token = strings.TrimSpace(token)
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+
+	// Without secrets, HMAC signed tokens are rejected.
+	var verifyHMAC func(signed, sig []byte, hash string) (bool, error)
+	if r.Secret != "" || len(r.Secrets) > 0 {
+		verifyHMAC = func(signed, sig []byte, hash string) (bool, error) {
+			return r.checkSecrets(req, func(secret string) (bool, error) {
+				return checkJWTHMAC(signed, sig, hash, secret)
+			})
+		}
+	}
+
+	claims, err := r.JWT.check(token, time.Now(), verifyHMAC)
+	if err != nil {
+		return false, err
+	}
+
+	req.Claims = claims
+
+	return true, nil
+}
+
+// signatureTolerance returns the maximum age of a timestamped signature.
+func (r MatchRule) signatureTolerance() time.Duration {
+	if r.tolerance == 0 {
+		return DefaultSignatureTolerance
+	}
+
+	return r.tolerance
+}
+
+// checkSecrets calls check with each of the rule's secrets that have not
+// expired, and returns true as soon as one of them matches. If the rule lists
+// several secrets, the index of the matching secret is logged so that it is
+// known when an old secret is no longer used.
+func (r MatchRule) checkSecrets(req *Request, check func(secret string) (bool, error)) (bool, error) {
+	if len(r.Secrets) == 0 {
+		return check(r.Secret)
+	}
+
+	var (
+		ok      bool
+		err     error
+		checked bool
+		now     = time.Now()
+	)
+
+	for i := range r.Secrets {
+		if r.Secrets[i].Expired(now) {
+			continue
+		}
+
+		checked = true
+
+		ok, err = check(r.Secrets[i].Value)
+		if ok && err == nil {
+			log.Printf("[%s] signature matched secret %d\n", req.ID, i)
+			return true, nil
+		}
+
+		if err != nil && !IsSignatureError(err) {
+			return false, err
+		}
+	}
+
+	if !checked {
+		return false, errors.New("all secrets have expired")
+	}
+
+	return ok, err
+}
+
 // compare is a helper function for constant time string comparisons.
 func compare(a, b string) bool {
 	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
@@ -976,3 +1999,13 @@ func compare(a, b string) bool {
 func getenv(s string) string {
 	return os.Getenv(s)
 }
+
+// toJSON provides a template function to render a value as JSON.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
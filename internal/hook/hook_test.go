@@ -1,11 +1,43 @@
 package hook
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestGetParameter(t *testing.T) {
@@ -180,7 +212,7 @@ func TestCheckScalrSignature(t *testing.T) {
 			Headers: testCase.headers,
 			Body:    testCase.body,
 		}
-		valid, err := checkScalrSignature(r, testCase.secret, false)
+		valid, err := checkScalrSignature(r, testCase.secret, 0)
 		if valid != testCase.ok {
 			t.Errorf("failed to check scalr signature fot test case: %s\nexpected ok:%#v, got ok:%#v}",
 				testCase.description, testCase.ok, valid)
@@ -205,6 +237,9 @@ var checkIPWhitelistTests = []struct {
 	{" [2001:db8:1:2::1:1234] ", "  2001:db8:1::/48 ", true, true},
 	{" [2001:db8:1:2::1:1234] ", "  2001:db8:1::/48 2001:db8:1::/64", true, true},
 	{" [2001:db8:1:2::1:1234] ", "  2001:db8:1::/64 ", false, true},
+	{"10.0.0.1", "10.0.0.0/31", true, true},
+	{"2001:db8:1:2::1", "2001:db8:1:2::/64", true, true},
+	{"[2001:db8::2]:1234", "2001:db8::1", false, true},
 }
 
 func TestCheckIPWhitelist(t *testing.T) {
@@ -265,6 +300,11 @@ var argumentGetTests = []struct {
 	{"request", "METHOD", nil, nil, map[string]interface{}{"a": "z"}, &http.Request{Method: "POST", RemoteAddr: "127.0.0.1:1234"}, "POST", true},
 	{"request", "remote-addr", nil, nil, map[string]interface{}{"a": "z"}, &http.Request{Method: "POST", RemoteAddr: "127.0.0.1:1234"}, "127.0.0.1:1234", true},
 	{"string", "a", nil, nil, map[string]interface{}{"a": "z"}, nil, "a", true},
+	{"header", "x-tag", map[string]interface{}{"X-Tag": RepeatedValues{"y", "z"}}, nil, nil, nil, "y", true},
+	{"header", "x-tag.1", map[string]interface{}{"X-Tag": RepeatedValues{"y", "z"}}, nil, nil, nil, "z", true},
+	{"url", "tag", nil, map[string]interface{}{"tag": RepeatedValues{"y", "z"}}, nil, nil, "y", true},
+	{"url", "tag.1", nil, map[string]interface{}{"tag": RepeatedValues{"y", "z"}}, nil, nil, "z", true},
+	{"entire-query", "", nil, map[string]interface{}{"a": "x", "tag": RepeatedValues{"y", "z"}}, nil, nil, `{"a":"x","tag":["y","z"]}`, true},
 	// failures
 	{"header", "a", nil, map[string]interface{}{"a": "z"}, map[string]interface{}{"a": "z"}, nil, "", false},  // nil headers
 	{"url", "a", map[string]interface{}{"A": "z"}, nil, map[string]interface{}{"a": "z"}, nil, "", false},     // nil query
@@ -274,7 +314,7 @@ var argumentGetTests = []struct {
 
 func TestArgumentGet(t *testing.T) {
 	for _, tt := range argumentGetTests {
-		a := Argument{tt.source, tt.name, "", false, ""}
+		a := Argument{Source: tt.source, Name: tt.name}
 		r := &Request{
 			Headers:    tt.headers,
 			Query:      tt.query,
@@ -294,14 +334,14 @@ var hookParseJSONParametersTests = []struct {
 	rheaders, rquery, rpayload map[string]interface{}
 	ok                         bool
 }{
-	{[]Argument{Argument{"header", "a", "", false, ""}}, map[string]interface{}{"A": `{"b": "y"}`}, nil, nil, map[string]interface{}{"A": map[string]interface{}{"b": "y"}}, nil, nil, true},
-	{[]Argument{Argument{"url", "a", "", false, ""}}, nil, map[string]interface{}{"a": `{"b": "y"}`}, nil, nil, map[string]interface{}{"a": map[string]interface{}{"b": "y"}}, nil, true},
-	{[]Argument{Argument{"payload", "a", "", false, ""}}, nil, nil, map[string]interface{}{"a": `{"b": "y"}`}, nil, nil, map[string]interface{}{"a": map[string]interface{}{"b": "y"}}, true},
-	{[]Argument{Argument{"header", "z", "", false, ""}}, map[string]interface{}{"Z": `{}`}, nil, nil, map[string]interface{}{"Z": map[string]interface{}{}}, nil, nil, true},
+	{[]Argument{Argument{Source: "header", Name: "a"}}, map[string]interface{}{"A": `{"b": "y"}`}, nil, nil, map[string]interface{}{"A": map[string]interface{}{"b": "y"}}, nil, nil, true},
+	{[]Argument{Argument{Source: "url", Name: "a"}}, nil, map[string]interface{}{"a": `{"b": "y"}`}, nil, nil, map[string]interface{}{"a": map[string]interface{}{"b": "y"}}, nil, true},
+	{[]Argument{Argument{Source: "payload", Name: "a"}}, nil, nil, map[string]interface{}{"a": `{"b": "y"}`}, nil, nil, map[string]interface{}{"a": map[string]interface{}{"b": "y"}}, true},
+	{[]Argument{Argument{Source: "header", Name: "z"}}, map[string]interface{}{"Z": `{}`}, nil, nil, map[string]interface{}{"Z": map[string]interface{}{}}, nil, nil, true},
 	// failures
-	{[]Argument{Argument{"header", "z", "", false, ""}}, map[string]interface{}{"Z": ``}, nil, nil, map[string]interface{}{"Z": ``}, nil, nil, false},     // empty string
-	{[]Argument{Argument{"header", "y", "", false, ""}}, map[string]interface{}{"X": `{}`}, nil, nil, map[string]interface{}{"X": `{}`}, nil, nil, false}, // missing parameter
-	{[]Argument{Argument{"string", "z", "", false, ""}}, map[string]interface{}{"Z": ``}, nil, nil, map[string]interface{}{"Z": ``}, nil, nil, false},     // invalid argument source
+	{[]Argument{Argument{Source: "header", Name: "z"}}, map[string]interface{}{"Z": ``}, nil, nil, map[string]interface{}{"Z": ``}, nil, nil, false},     // empty string
+	{[]Argument{Argument{Source: "header", Name: "y"}}, map[string]interface{}{"X": `{}`}, nil, nil, map[string]interface{}{"X": `{}`}, nil, nil, false}, // missing parameter
+	{[]Argument{Argument{Source: "string", Name: "z"}}, map[string]interface{}{"Z": ``}, nil, nil, map[string]interface{}{"Z": ``}, nil, nil, false},     // invalid argument source
 }
 
 func TestHookParseJSONParameters(t *testing.T) {
@@ -326,9 +366,9 @@ var hookExtractCommandArgumentsTests = []struct {
 	value                   []string
 	ok                      bool
 }{
-	{"test", []Argument{Argument{"header", "a", "", false, ""}}, map[string]interface{}{"A": "z"}, nil, nil, []string{"test", "z"}, true},
+	{"test", []Argument{Argument{Source: "header", Name: "a"}}, map[string]interface{}{"A": "z"}, nil, nil, []string{"test", "z"}, true},
 	// failures
-	{"fail", []Argument{Argument{"payload", "a", "", false, ""}}, map[string]interface{}{"A": "z"}, nil, nil, []string{"fail", ""}, false},
+	{"fail", []Argument{Argument{Source: "payload", Name: "a"}}, map[string]interface{}{"A": "z"}, nil, nil, []string{"fail", ""}, false},
 }
 
 func TestHookExtractCommandArguments(t *testing.T) {
@@ -375,14 +415,14 @@ var hookExtractCommandArgumentsForEnvTests = []struct {
 	// successes
 	{
 		"test",
-		[]Argument{Argument{"header", "a", "", false, ""}},
+		[]Argument{Argument{Source: "header", Name: "a"}},
 		map[string]interface{}{"A": "z"}, nil, nil,
 		[]string{"HOOK_a=z"},
 		true,
 	},
 	{
 		"test",
-		[]Argument{Argument{"header", "a", "MYKEY", false, ""}},
+		[]Argument{Argument{Source: "header", Name: "a", EnvName: "MYKEY"}},
 		map[string]interface{}{"A": "z"}, nil, nil,
 		[]string{"MYKEY=z"},
 		true,
@@ -390,7 +430,7 @@ var hookExtractCommandArgumentsForEnvTests = []struct {
 	// failures
 	{
 		"fail",
-		[]Argument{Argument{"payload", "a", "", false, ""}},
+		[]Argument{Argument{Source: "payload", Name: "a"}},
 		map[string]interface{}{"A": "z"}, nil, nil,
 		[]string{},
 		false,
@@ -489,24 +529,24 @@ var matchRuleTests = []struct {
 	ok                                 bool
 	err                                bool
 }{
-	{"value", "", "", "z", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", true, false},
-	{"regex", "^z", "", "z", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", true, false},
-	{"payload-hmac-sha1", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "b17e04cbb22afa8ffbff8796fc1894ed27badd9e"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
-	{"payload-hash-sha1", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "b17e04cbb22afa8ffbff8796fc1894ed27badd9e"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
-	{"payload-hmac-sha256", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "f417af3a21bd70379b5796d5f013915e7029f62c580fb0f500f59a35a6f04c89"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
-	{"payload-hash-sha256", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "f417af3a21bd70379b5796d5f013915e7029f62c580fb0f500f59a35a6f04c89"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
+	{"value", "", "", "z", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", true, false},
+	{"regex", "^z", "", "z", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", true, false},
+	{"payload-hmac-sha1", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "b17e04cbb22afa8ffbff8796fc1894ed27badd9e"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
+	{"payload-hash-sha1", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "b17e04cbb22afa8ffbff8796fc1894ed27badd9e"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
+	{"payload-hmac-sha256", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "f417af3a21bd70379b5796d5f013915e7029f62c580fb0f500f59a35a6f04c89"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
+	{"payload-hash-sha256", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "f417af3a21bd70379b5796d5f013915e7029f62c580fb0f500f59a35a6f04c89"}, nil, nil, []byte(`{"a": "z"}`), "", true, false},
 	// failures
-	{"value", "", "", "X", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", false, false},
-	{"regex", "^X", "", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", false, false},
-	{"value", "", "2", "X", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"Y": "z"}, nil, nil, []byte{}, "", false, true}, // reference invalid header
+	{"value", "", "", "X", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", false, false},
+	{"regex", "^X", "", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", false, false},
+	{"value", "", "2", "X", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"Y": "z"}, nil, nil, []byte{}, "", false, true}, // reference invalid header
 	// errors
-	{"regex", "*", "", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", false, true},                   // invalid regex
-	{"payload-hmac-sha1", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true},   // invalid hmac
-	{"payload-hash-sha1", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true},   // invalid hmac
-	{"payload-hmac-sha256", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
-	{"payload-hash-sha256", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
-	{"payload-hmac-sha512", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
-	{"payload-hash-sha512", "", "secret", "", "", Argument{"header", "a", "", false, ""}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
+	{"regex", "*", "", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, "", false, true},                   // invalid regex
+	{"payload-hmac-sha1", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true},   // invalid hmac
+	{"payload-hash-sha1", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true},   // invalid hmac
+	{"payload-hmac-sha256", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
+	{"payload-hash-sha256", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
+	{"payload-hmac-sha512", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
+	{"payload-hash-sha512", "", "secret", "", "", Argument{Source: "header", Name: "a"}, map[string]interface{}{"A": ""}, nil, nil, []byte{}, "", false, true}, // invalid hmac
 	// IP whitelisting, valid cases
 	{"ip-whitelist", "", "", "", "192.168.0.1/24", Argument{}, nil, nil, nil, []byte{}, "192.168.0.2:9000", true, false}, // valid IPv4, with range
 	{"ip-whitelist", "", "", "", "192.168.0.1/24", Argument{}, nil, nil, nil, []byte{}, "192.168.0.2:9000", true, false}, // valid IPv4, with range
@@ -524,7 +564,7 @@ var matchRuleTests = []struct {
 
 func TestMatchRule(t *testing.T) {
 	for i, tt := range matchRuleTests {
-		r := MatchRule{tt.typ, tt.regex, tt.secret, tt.value, tt.param, tt.ipRange}
+		r := MatchRule{Type: tt.typ, Regex: tt.regex, Secret: tt.secret, Value: tt.value, Parameter: tt.param, IPRange: tt.ipRange}
 		req := &Request{
 			Headers: tt.headers,
 			Query:   tt.query,
@@ -541,6 +581,23 @@ func TestMatchRule(t *testing.T) {
 	}
 }
 
+func TestMatchRuleIPWhitelistClientAddr(t *testing.T) {
+	r := MatchRule{Type: IPWhitelist, IPRange: "203.0.113.0/24"}
+	req := &Request{
+		RawRequest: &http.Request{RemoteAddr: "10.0.0.1:9000"},
+		RemoteAddr: "203.0.113.7",
+	}
+
+	if ok, err := r.Evaluate(req); !ok || err != nil {
+		t.Errorf("expected client address to match, got %#v (%v)", ok, err)
+	}
+
+	a := Argument{Source: SourceRequest, Name: "remote-addr"}
+	if v, err := a.Get(req); v != "203.0.113.7" || err != nil {
+		t.Errorf("expected remote-addr %q, got %q (%v)", "203.0.113.7", v, err)
+	}
+}
+
 var andRuleTests = []struct {
 	desc                    string // description of the test case
 	rule                    AndRule
@@ -552,8 +609,8 @@ var andRuleTests = []struct {
 	{
 		"(a=z, b=y): a=z && b=y",
 		AndRule{
-			{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}},
-			{Match: &MatchRule{"value", "", "", "y", Argument{"header", "b", "", false, ""}, ""}},
+			{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}},
+			{Match: &MatchRule{Type: "value", Value: "y", Parameter: Argument{Source: "header", Name: "b"}}},
 		},
 		map[string]interface{}{"A": "z", "B": "y"}, nil, nil,
 		[]byte{},
@@ -562,8 +619,8 @@ var andRuleTests = []struct {
 	{
 		"(a=z, b=Y): a=z && b=y",
 		AndRule{
-			{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}},
-			{Match: &MatchRule{"value", "", "", "y", Argument{"header", "b", "", false, ""}, ""}},
+			{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}},
+			{Match: &MatchRule{Type: "value", Value: "y", Parameter: Argument{Source: "header", Name: "b"}}},
 		},
 		map[string]interface{}{"A": "z", "B": "Y"}, nil, nil,
 		[]byte{},
@@ -573,22 +630,22 @@ var andRuleTests = []struct {
 	{
 		"(a=z, b=y, c=x, d=w=, e=X, f=X): a=z && (b=y && c=x) && (d=w || e=v) && !f=u",
 		AndRule{
-			{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}},
+			{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}},
 			{
 				And: &AndRule{
-					{Match: &MatchRule{"value", "", "", "y", Argument{"header", "b", "", false, ""}, ""}},
-					{Match: &MatchRule{"value", "", "", "x", Argument{"header", "c", "", false, ""}, ""}},
+					{Match: &MatchRule{Type: "value", Value: "y", Parameter: Argument{Source: "header", Name: "b"}}},
+					{Match: &MatchRule{Type: "value", Value: "x", Parameter: Argument{Source: "header", Name: "c"}}},
 				},
 			},
 			{
 				Or: &OrRule{
-					{Match: &MatchRule{"value", "", "", "w", Argument{"header", "d", "", false, ""}, ""}},
-					{Match: &MatchRule{"value", "", "", "v", Argument{"header", "e", "", false, ""}, ""}},
+					{Match: &MatchRule{Type: "value", Value: "w", Parameter: Argument{Source: "header", Name: "d"}}},
+					{Match: &MatchRule{Type: "value", Value: "v", Parameter: Argument{Source: "header", Name: "e"}}},
 				},
 			},
 			{
 				Not: &NotRule{
-					Match: &MatchRule{"value", "", "", "u", Argument{"header", "f", "", false, ""}, ""},
+					Match: &MatchRule{Type: "value", Value: "u", Parameter: Argument{Source: "header", Name: "f"}},
 				},
 			},
 		},
@@ -600,7 +657,7 @@ var andRuleTests = []struct {
 	// failures
 	{
 		"invalid rule",
-		AndRule{{Match: &MatchRule{"value", "", "", "X", Argument{"header", "a", "", false, ""}, ""}}},
+		AndRule{{Match: &MatchRule{Type: "value", Value: "X", Parameter: Argument{Source: "header", Name: "a"}}}},
 		map[string]interface{}{"Y": "z"}, nil, nil, nil,
 		false, true,
 	},
@@ -632,8 +689,8 @@ var orRuleTests = []struct {
 	{
 		"(a=z, b=X): a=z || b=y",
 		OrRule{
-			{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}},
-			{Match: &MatchRule{"value", "", "", "y", Argument{"header", "b", "", false, ""}, ""}},
+			{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}},
+			{Match: &MatchRule{Type: "value", Value: "y", Parameter: Argument{Source: "header", Name: "b"}}},
 		},
 		map[string]interface{}{"A": "z", "B": "X"}, nil, nil,
 		[]byte{},
@@ -642,8 +699,8 @@ var orRuleTests = []struct {
 	{
 		"(a=X, b=y): a=z || b=y",
 		OrRule{
-			{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}},
-			{Match: &MatchRule{"value", "", "", "y", Argument{"header", "b", "", false, ""}, ""}},
+			{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}},
+			{Match: &MatchRule{Type: "value", Value: "y", Parameter: Argument{Source: "header", Name: "b"}}},
 		},
 		map[string]interface{}{"A": "X", "B": "y"}, nil, nil,
 		[]byte{},
@@ -652,8 +709,8 @@ var orRuleTests = []struct {
 	{
 		"(a=Z, b=Y): a=z || b=y",
 		OrRule{
-			{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}},
-			{Match: &MatchRule{"value", "", "", "y", Argument{"header", "b", "", false, ""}, ""}},
+			{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}},
+			{Match: &MatchRule{Type: "value", Value: "y", Parameter: Argument{Source: "header", Name: "b"}}},
 		},
 		map[string]interface{}{"A": "Z", "B": "Y"}, nil, nil,
 		[]byte{},
@@ -663,7 +720,7 @@ var orRuleTests = []struct {
 	{
 		"missing parameter node",
 		OrRule{
-			{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}},
+			{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}},
 		},
 		map[string]interface{}{"Y": "Z"}, nil, nil,
 		[]byte{},
@@ -694,8 +751,8 @@ var notRuleTests = []struct {
 	ok                      bool
 	err                     bool
 }{
-	{"(a=z): !a=X", NotRule{Match: &MatchRule{"value", "", "", "X", Argument{"header", "a", "", false, ""}, ""}}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, true, false},
-	{"(a=z): !a=z", NotRule{Match: &MatchRule{"value", "", "", "z", Argument{"header", "a", "", false, ""}, ""}}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, false, false},
+	{"(a=z): !a=X", NotRule{Match: &MatchRule{Type: "value", Value: "X", Parameter: Argument{Source: "header", Name: "a"}}}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, true, false},
+	{"(a=z): !a=z", NotRule{Match: &MatchRule{Type: "value", Value: "z", Parameter: Argument{Source: "header", Name: "a"}}}, map[string]interface{}{"A": "z"}, nil, nil, []byte{}, false, false},
 }
 
 func TestNotRule(t *testing.T) {
@@ -726,3 +783,1915 @@ func TestCompare(t *testing.T) {
 		}
 	}
 }
+
+var hookRenderResponseTests = []struct {
+	desc    string
+	message string
+	data    *ResponseData
+	value   string
+	ok      bool
+}{
+	{"static", "ok", &ResponseData{}, "ok", true},
+	{"payload", "hi {{ .Request.Payload.user }}", &ResponseData{Request: &Request{Payload: map[string]interface{}{"user": "bob"}}}, "hi bob", true},
+	{"output", "{{ .ExitCode }}: {{ .Output }}", &ResponseData{Output: "done", ExitCode: 2}, "2: done", true},
+	{"json", `{"text": {{ json .Output }}}`, &ResponseData{Output: `a "b"`}, `{"text": "a \"b\""}`, true},
+	// failures
+	{"parse error", "{{ .Output ", &ResponseData{}, "", false},
+	{"exec error", "{{ .Missing }}", &ResponseData{}, "", false},
+}
+
+func TestHookRenderResponse(t *testing.T) {
+	for _, tt := range hookRenderResponseTests {
+		h := &Hook{ID: "test", ResponseMessage: tt.message, ResponseMessageAsTemplate: true}
+		value, err := h.RenderResponse(tt.data)
+		if (err == nil) != tt.ok || value != tt.value {
+			t.Errorf("failed to render %q:\nexpected {value:%#v, ok:%#v},\ngot {value:%#v, err:%v}", tt.desc, tt.value, tt.ok, value, err)
+		}
+	}
+}
+
+func TestHooksLoadFromFileInvalidResponseTemplate(t *testing.T) {
+	f, err := ioutil.TempFile("", "hooks-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`[{"id": "bad", "execute-command": "true", "response-message": "{{ .Output ", "response-message-as-template": true}]`)
+	f.Close()
+
+	h := &Hooks{}
+	err = h.LoadFromFile(f.Name(), false)
+	if err == nil || !strings.Contains(err.Error(), `hook "bad": response-message`) {
+		t.Errorf("expected response template error, got: %v", err)
+	}
+}
+
+func TestHooksLoadFromFileInvalidPatterns(t *testing.T) {
+	f, err := ioutil.TempFile("", "hooks-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`[{
+		"id": "bad",
+		"execute-command": "true",
+		"pass-arguments-to-command": [{"source": "payload", "expression": "$.commits["}],
+		"trigger-rule": {"and": [
+			{"match": {"type": "value", "value": "x", "parameter": {"source": "payload", "name": "a"}}},
+			{"match": {"type": "regex", "regex": "refs/(heads", "parameter": {"source": "payload", "name": "ref"}}},
+			{"match": {"type": "value", "value": "x", "parameter": {"source": "payload", "expression": "commits"}}}
+		]}
+	}]`)
+	f.Close()
+
+	h := &Hooks{}
+	err = h.LoadFromFile(f.Name(), false)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, path := range []string{
+		`hook "bad": pass-arguments-to-command[0].expression`,
+		`hook "bad": trigger-rule.and[1].match.regex`,
+		`hook "bad": trigger-rule.and[2].match.parameter.expression`,
+	} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("expected error for %s, got: %v", path, err)
+		}
+	}
+}
+
+func TestPreparedPatterns(t *testing.T) {
+	var r MatchRule
+	if err := yaml.Unmarshal([]byte(`{type: regex, regex: "^refs/heads/", parameter: {source: payload, expression: "$.ref"}}`), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &configChecker{hook: "test"}
+	r.prepare(c, "match")
+	if len(c.errs) != 0 {
+		t.Fatalf("unexpected errors: %v", c.errs)
+	}
+
+	if r.regex == nil || r.Parameter.jpath == nil {
+		t.Fatal("expected regex and expression to be compiled")
+	}
+
+	req := &Request{Payload: map[string]interface{}{"ref": "refs/heads/main"}}
+	if ok, err := r.Evaluate(req); !ok || err != nil {
+		t.Errorf("expected match, got %t (%v)", ok, err)
+	}
+
+	if _, err := ExtractParameterAsString("", req.Payload, "$.ref["); err == nil {
+		t.Error("expected error for invalid JSONPath expression")
+	}
+}
+
+func TestHookRedactedCommandArguments(t *testing.T) {
+	h := &Hook{
+		ExecuteCommand: "test",
+		PassArgumentsToCommand: []Argument{
+			{Source: "header", Name: "a"},
+			{Source: "header", Name: "authorization"},
+			{Source: "payload", Name: "token", Sensitive: true},
+		},
+		PassEnvironmentToCommand: []Argument{
+			{Source: "header", Name: "a"},
+			{Source: "payload", Name: "token", EnvName: "TOKEN", Sensitive: true},
+		},
+	}
+	r := &Request{
+		Headers: map[string]interface{}{"A": "z", "Authorization": "Bearer secret"},
+		Payload: map[string]interface{}{"token": "secret"},
+	}
+
+	args := h.RedactedCommandArguments(r)
+	if expect := []string{"test", "z", "[redacted]", "[redacted]"}; !reflect.DeepEqual(args, expect) {
+		t.Errorf("failed to redact args:\nexpected %#v\ngot %#v", expect, args)
+	}
+
+	envs := h.RedactedCommandArgumentsForEnv(r)
+	if expect := []string{"HOOK_a=z", "TOKEN=[redacted]"}; !reflect.DeepEqual(envs, expect) {
+		t.Errorf("failed to redact env:\nexpected %#v\ngot %#v", expect, envs)
+	}
+
+	if args, _ := h.ExtractCommandArguments(r); args[2] != "Bearer secret" || args[3] != "secret" {
+		t.Errorf("redaction modified the request: %#v", args)
+	}
+}
+
+func TestHooksLoadFromFileSecretRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks-secrets-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "gh")
+	if err := ioutil.WriteFile(secretFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("XXXTEST_ENV_SECRET", "env-secret")
+	defer os.Unsetenv("XXXTEST_ENV_SECRET")
+
+	for _, tt := range []struct {
+		desc, config string
+		errMatch     string
+	}{
+		{
+			"valid references",
+			`- id: secrets
+  execute-command: "true"
+  pass-arguments-to-command:
+  - source: secret
+    secret: {env: XXXTEST_ENV_SECRET}
+  trigger-rule:
+    and:
+    - match: {type: payload-hmac-sha1, secret: {file: ` + secretFile + `}, parameter: {source: header, name: X-Hub-Signature}}
+    - match: {type: value, value: x, parameter: {source: secret, secret: {env: XXXTEST_ENV_SECRET}}}
+`,
+			"",
+		},
+		{
+			"missing file",
+			`[{"id": "bad-file", "trigger-rule": {"and": [{"match": {"type": "value"}}, {"match": {"type": "payload-hmac-sha1", "secret": {"file": "` + filepath.Join(dir, "missing") + `"}}}]}}]`,
+			`hook "bad-file": trigger-rule.and[1].match.secret: reading secret file`,
+		},
+		{
+			"missing env",
+			`[{"id": "bad-env", "pass-environment-to-command": [{"source": "secret", "secret": {"env": "XXXTEST_MISSING_SECRET"}}]}]`,
+			`hook "bad-env": pass-environment-to-command[0].secret: secret environment variable XXXTEST_MISSING_SECRET is not set`,
+		},
+		{
+			"missing reference",
+			`[{"id": "bad-ref", "pass-arguments-to-command": [{"source": "secret", "name": "x"}]}]`,
+			`hook "bad-ref": pass-arguments-to-command[0]: missing secret reference`,
+		},
+	} {
+		path := filepath.Join(dir, "hooks.yaml")
+		if err := ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		h := &Hooks{}
+		err := h.LoadFromFile(path, false)
+
+		if tt.errMatch != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.errMatch) {
+				t.Errorf("%s: expected error containing %q, got: %v", tt.desc, tt.errMatch, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			continue
+		}
+
+		hook := h.Match("secrets")
+		if s := (*hook.TriggerRule.And)[0].Match.Secret; s != "file-secret" {
+			t.Errorf("%s: expected rule secret %q, got %q", tt.desc, "file-secret", s)
+		}
+
+		if v, err := hook.PassArgumentsToCommand[0].Get(&Request{}); err != nil || v != "env-secret" {
+			t.Errorf("%s: expected argument secret %q, got %q (%v)", tt.desc, "env-secret", v, err)
+		}
+
+		if args := hook.RedactedCommandArguments(&Request{}); args[1] != "[redacted]" {
+			t.Errorf("%s: secret argument not redacted: %#v", tt.desc, args)
+		}
+
+		if s := fmt.Sprintf("%+v", hook.PassArgumentsToCommand[0]); strings.Contains(s, "env-secret") {
+			t.Errorf("%s: formatted argument discloses secret: %s", tt.desc, s)
+		}
+	}
+}
+
+func TestMatchRuleSecrets(t *testing.T) {
+	req := &Request{
+		ID:      "test",
+		Headers: map[string]interface{}{"A": "b17e04cbb22afa8ffbff8796fc1894ed27badd9e"},
+		Body:    []byte(`{"a": "z"}`),
+	}
+
+	for _, tt := range []struct {
+		desc, config string
+		ok           bool
+		err          bool
+		prepareErr   string
+	}{
+		{
+			"second secret matches",
+			`{type: payload-hmac-sha1, secrets: [other, secret], parameter: {source: header, name: a}}`,
+			true, false, "",
+		},
+		{
+			"not yet expired",
+			`{type: payload-hmac-sha1, secrets: [{value: secret, not-after: "2999-01-01T00:00:00Z"}], parameter: {source: header, name: a}}`,
+			true, false, "",
+		},
+		{
+			"matching secret expired",
+			`{type: payload-hmac-sha1, secrets: [{value: secret, not-after: 2000-01-01}, other], parameter: {source: header, name: a}}`,
+			false, true, "",
+		},
+		{
+			"all secrets expired",
+			`{type: payload-hmac-sha1, secrets: [{value: secret, not-after: 2000-01-01}], parameter: {source: header, name: a}}`,
+			false, true, "",
+		},
+		{
+			"secret and secrets",
+			`{type: payload-hmac-sha1, secret: secret, secrets: [other], parameter: {source: header, name: a}}`,
+			false, false, "only one of secret or secrets may be set",
+		},
+		{
+			"invalid expiry",
+			`{type: payload-hmac-sha1, secrets: [{value: secret, not-after: tomorrow}], parameter: {source: header, name: a}}`,
+			false, false, `match.secrets[0].not-after: invalid time "tomorrow"`,
+		},
+	} {
+		var r MatchRule
+		if err := yaml.Unmarshal([]byte(tt.config), &r); err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+
+		if tt.prepareErr != "" {
+			if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.prepareErr) {
+				t.Errorf("%s: expected error containing %q, got: %v", tt.desc, tt.prepareErr, c.errs)
+			}
+			continue
+		}
+
+		if len(c.errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.desc, c.errs)
+			continue
+		}
+
+		ok, err := r.Evaluate(req)
+		if ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("%s: expected %#v (error %t), got %#v (%v)", tt.desc, tt.ok, tt.err, ok, err)
+		}
+	}
+
+}
+
+func TestMatchRuleScalarValues(t *testing.T) {
+	for _, tt := range []struct {
+		desc, config string
+		unmarshal    func([]byte, interface{}) error
+	}{
+		{"yaml", `{type: value, value: 123, secret: 12345}`, func(b []byte, v interface{}) error { return yaml.Unmarshal(b, v) }},
+		{"json", `{"type": "value", "value": 123, "secret": 12345}`, json.Unmarshal},
+	} {
+		var r MatchRule
+		if err := tt.unmarshal([]byte(tt.config), &r); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+			continue
+		}
+
+		if r.Value != "123" || r.Secret != "12345" {
+			t.Errorf("%s: expected value %q and secret %q, got %q and %q", tt.desc, "123", "12345", r.Value, r.Secret)
+		}
+	}
+
+	var r MatchRule
+	if err := json.Unmarshal([]byte(`{"type": "value", "secret": [1, 2]}`), &r); err == nil {
+		t.Errorf("expected error for a non-scalar secret, got secret %q", r.Secret)
+	}
+}
+
+func TestMatchRuleGitHubSignature(t *testing.T) {
+	body := []byte(`{"a": "z"}`)
+	sha1Sig := "sha1=b17e04cbb22afa8ffbff8796fc1894ed27badd9e"
+	sha256Sig := "sha256=f417af3a21bd70379b5796d5f013915e7029f62c580fb0f500f59a35a6f04c89"
+
+	var r MatchRule
+	if err := yaml.Unmarshal([]byte(`{type: github-signature, secret: secret, replay-window: 1h}`), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &configChecker{hook: "test"}
+	r.prepare(c, "match")
+	if len(c.errs) != 0 {
+		t.Fatalf("unexpected errors: %v", c.errs)
+	}
+
+	for _, tt := range []struct {
+		desc    string
+		hook    string
+		headers map[string]interface{}
+		ok      bool
+		sigErr  bool
+	}{
+		{"sha256", "test", map[string]interface{}{"X-Hub-Signature-256": sha256Sig, "X-Github-Delivery": "1"}, true, false},
+		{"sha1 fallback", "test", map[string]interface{}{"X-Hub-Signature": sha1Sig, "X-Github-Delivery": "2"}, true, false},
+		{"sha256 preferred", "test", map[string]interface{}{"X-Hub-Signature-256": "sha256=00", "X-Hub-Signature": sha1Sig, "X-Github-Delivery": "3"}, false, true},
+		{"missing signature", "test", map[string]interface{}{"X-Github-Delivery": "4"}, false, true},
+		{"missing delivery", "test", map[string]interface{}{"X-Hub-Signature-256": sha256Sig}, false, true},
+		{"replayed delivery", "test", map[string]interface{}{"X-Hub-Signature-256": sha256Sig, "X-Github-Delivery": "1"}, false, true},
+		{"delivery to another hook", "other", map[string]interface{}{"X-Hub-Signature-256": sha256Sig, "X-Github-Delivery": "1"}, true, false},
+	} {
+		ok, err := r.Evaluate(&Request{ID: "test", HookID: tt.hook, Headers: tt.headers, Body: body})
+		if ok != tt.ok || IsSignatureError(err) != tt.sigErr {
+			t.Errorf("%s: expected %#v (signature error %t), got %#v (%v)", tt.desc, tt.ok, tt.sigErr, ok, err)
+		}
+	}
+
+	// A forgotten delivery can be retried.
+	req := &Request{ID: "test", HookID: "test", Headers: map[string]interface{}{"X-Hub-Signature-256": sha256Sig, "X-Github-Delivery": "5"}, Body: body}
+	if ok, err := r.Evaluate(req); !ok || err != nil {
+		t.Fatalf("expected delivery to be verified, got %t (%v)", ok, err)
+	}
+
+	req.ForgetDeliveries()
+
+	if ok, err := r.Evaluate(req); !ok || err != nil {
+		t.Errorf("expected forgotten delivery to be verified again, got %t (%v)", ok, err)
+	}
+
+	var bad MatchRule
+	if err := yaml.Unmarshal([]byte(`{type: github-signature, secret: secret, replay-window: soon}`), &bad); err != nil {
+		t.Fatal(err)
+	}
+
+	c = &configChecker{hook: "test"}
+	bad.prepare(c, "match")
+	if len(c.errs) != 1 || !strings.Contains(c.errs[0].Error(), "match.replay-window") {
+		t.Errorf("expected replay-window error, got: %v", c.errs)
+	}
+}
+
+func TestDeliveryCache(t *testing.T) {
+	c := newDeliveryCache(2)
+	now := time.Now()
+
+	if c.Replayed("a", time.Minute, now) {
+		t.Error("first delivery reported as replayed")
+	}
+	if !c.Replayed("a", time.Minute, now.Add(time.Second)) {
+		t.Error("repeated delivery within window not reported as replayed")
+	}
+	if c.Replayed("a", time.Minute, now.Add(2*time.Minute)) {
+		t.Error("repeated delivery outside window reported as replayed")
+	}
+
+	c.Replayed("b", time.Minute, now.Add(2*time.Minute))
+	c.Replayed("c", time.Minute, now.Add(2*time.Minute))
+
+	if len(c.seen) > 2 {
+		t.Errorf("cache exceeds its bound: %d entries", len(c.seen))
+	}
+	if c.Replayed("a", time.Minute, now.Add(2*time.Minute)) {
+		t.Error("evicted delivery reported as replayed")
+	}
+}
+
+func TestMatchRuleForgeSignatures(t *testing.T) {
+	body := []byte(`{"a": "z"}`)
+	sig := "f417af3a21bd70379b5796d5f013915e7029f62c580fb0f500f59a35a6f04c89"
+
+	for _, tt := range []struct {
+		desc    string
+		typ     string
+		headers map[string]interface{}
+		ok      bool
+		sigErr  bool
+	}{
+		{"gitlab token", GitLabToken, map[string]interface{}{"X-Gitlab-Token": "secret"}, true, false},
+		{"gitlab wrong token", GitLabToken, map[string]interface{}{"X-Gitlab-Token": "other"}, false, true},
+		{"gitlab missing token", GitLabToken, map[string]interface{}{}, false, true},
+		{"gitea", GiteaSignature, map[string]interface{}{"X-Gitea-Signature": sig}, true, false},
+		{"gogs", GiteaSignature, map[string]interface{}{"X-Gogs-Signature": sig}, true, false},
+		{"gitea invalid", GiteaSignature, map[string]interface{}{"X-Gitea-Signature": "00"}, false, true},
+		{"gitea missing", GiteaSignature, map[string]interface{}{"X-Hub-Signature": "sha256=" + sig}, false, true},
+		{"bitbucket server", BitbucketServerSignature, map[string]interface{}{"X-Hub-Signature": "sha256=" + sig}, true, false},
+		{"bitbucket server invalid", BitbucketServerSignature, map[string]interface{}{"X-Hub-Signature": "sha256=00"}, false, true},
+		{"bitbucket server missing", BitbucketServerSignature, map[string]interface{}{"X-Gitea-Signature": sig}, false, true},
+	} {
+		r := MatchRule{Type: tt.typ, Secret: "secret"}
+
+		ok, err := r.Evaluate(&Request{ID: "test", Headers: tt.headers, Body: body})
+		if ok != tt.ok || IsSignatureError(err) != tt.sigErr {
+			t.Errorf("%s: expected %#v (signature error %t), got %#v (%v)", tt.desc, tt.ok, tt.sigErr, ok, err)
+		}
+
+		if err != nil && strings.Contains(err.Error(), "other") {
+			t.Errorf("%s: error discloses token: %v", tt.desc, err)
+		}
+	}
+}
+
+func TestMatchRuleTimestampedSignatures(t *testing.T) {
+	body := []byte(`{"a": "z"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	sign := func(h func() hash.Hash, s string) []byte {
+		mac := hmac.New(h, []byte("secret"))
+		mac.Write([]byte(s))
+		return mac.Sum(nil)
+	}
+
+	stripe := func(ts string) string {
+		return "t=" + ts + ",v1=00,v1=" + hex.EncodeToString(sign(sha256.New, ts+"."+string(body)))
+	}
+
+	for _, tt := range []struct {
+		desc    string
+		config  string
+		headers map[string]interface{}
+		ok      bool
+		sigErr  bool
+	}{
+		{
+			"stripe",
+			`{type: stripe-signature, secret: secret}`,
+			map[string]interface{}{"Stripe-Signature": stripe(now)},
+			true, false,
+		},
+		{
+			"stripe outdated",
+			`{type: stripe-signature, secret: secret}`,
+			map[string]interface{}{"Stripe-Signature": stripe(old)},
+			false, true,
+		},
+		{
+			"stripe within tolerance",
+			`{type: stripe-signature, secret: secret, tolerance: 15m}`,
+			map[string]interface{}{"Stripe-Signature": stripe(old)},
+			true, false,
+		},
+		{
+			"stripe wrong secret",
+			`{type: stripe-signature, secret: other}`,
+			map[string]interface{}{"Stripe-Signature": stripe(now)},
+			false, true,
+		},
+		{
+			"slack",
+			`{type: slack-signature, secret: secret}`,
+			map[string]interface{}{
+				"X-Slack-Request-Timestamp": now,
+				"X-Slack-Signature":         "v0=" + hex.EncodeToString(sign(sha256.New, "v0:"+now+":"+string(body))),
+			},
+			true, false,
+		},
+		{
+			"slack missing timestamp",
+			`{type: slack-signature, secret: secret}`,
+			map[string]interface{}{"X-Slack-Signature": "v0=00"},
+			false, true,
+		},
+		{
+			"generic",
+			`{type: timestamped-hmac, secret: secret, timestamped-hmac: {signature-header: x-signature, timestamp-header: x-timestamp, signed-string: "{{index .Headers \"X-Id\"}}/{{.Timestamp}}/{{.Body}}", algorithm: sha1, encoding: base64}}`,
+			map[string]interface{}{
+				"X-Id":        "id",
+				"X-Timestamp": now,
+				"X-Signature": base64.StdEncoding.EncodeToString(sign(sha1.New, "id/"+now+"/"+string(body))),
+			},
+			true, false,
+		},
+	} {
+		var r MatchRule
+		if err := yaml.Unmarshal([]byte(tt.config), &r); err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+		if len(c.errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.desc, c.errs)
+			continue
+		}
+
+		ok, err := r.Evaluate(&Request{ID: "test", Headers: tt.headers, Body: body})
+		if ok != tt.ok || IsSignatureError(err) != tt.sigErr {
+			t.Errorf("%s: expected %#v (signature error %t), got %#v (%v)", tt.desc, tt.ok, tt.sigErr, ok, err)
+		}
+	}
+
+	var r MatchRule
+	if err := yaml.Unmarshal([]byte(`{type: timestamped-hmac, secret: secret, tolerance: -1s, timestamped-hmac: {algorithm: md5}}`), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &configChecker{hook: "test"}
+	r.prepare(c, "match")
+
+	var errs []string
+	for _, err := range c.errs {
+		errs = append(errs, err.Error())
+	}
+
+	for _, want := range []string{"match.tolerance", "match.timestamped-hmac.signature-header", "match.timestamped-hmac.algorithm"} {
+		if !strings.Contains(strings.Join(errs, "\n"), want) {
+			t.Errorf("expected error for %s, got: %v", want, errs)
+		}
+	}
+}
+
+func TestMatchRulePublicKeySignature(t *testing.T) {
+	body := []byte(`{"a": "z"}`)
+	digest := sha256.Sum256(body)
+
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pemKey := func(key interface{}) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+
+	dir, err := ioutil.TempDir("", "hooks-public-key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaFile := filepath.Join(dir, "rsa.pem")
+	if err := ioutil.WriteFile(rsaFile, []byte(pemKey(&rsaKey.PublicKey)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	edSig := hex.EncodeToString(ed25519.Sign(edPriv, append([]byte("1600000000"), body...)))
+
+	pkcs1Sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pssSig, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecR, ecS, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecASN1, err := asn1.Marshal(struct{ R, S *big.Int }{ecR, ecS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecRaw := make([]byte, 64)
+	ecR.FillBytes(ecRaw[:32])
+	ecS.FillBytes(ecRaw[32:])
+
+	for _, tt := range []struct {
+		desc      string
+		key       PublicKey
+		signature string
+		ok        bool
+		sigErr    bool
+	}{
+		{
+			"ed25519 with signed message",
+			PublicKey{Key: hex.EncodeToString(edPub), Algorithm: "ed25519", Encoding: "hex", SignedMessage: `{{index .Headers "X-Signature-Timestamp"}}{{.Body}}`},
+			edSig, true, false,
+		},
+		{
+			"ed25519 wrong message",
+			PublicKey{Key: hex.EncodeToString(edPub), Algorithm: "ed25519", Encoding: "hex"},
+			edSig, false, true,
+		},
+		{
+			"rsa pkcs1v15 from file",
+			PublicKey{KeyFile: rsaFile, Algorithm: "rsa-sha256"},
+			base64.StdEncoding.EncodeToString(pkcs1Sig), true, false,
+		},
+		{
+			"rsa pss",
+			PublicKey{Key: pemKey(&rsaKey.PublicKey), Algorithm: "rsa-pss-sha256"},
+			base64.StdEncoding.EncodeToString(pssSig), true, false,
+		},
+		{
+			"rsa pss signature checked as pkcs1v15",
+			PublicKey{Key: pemKey(&rsaKey.PublicKey), Algorithm: "rsa-sha256"},
+			base64.StdEncoding.EncodeToString(pssSig), false, true,
+		},
+		{
+			"ecdsa asn1",
+			PublicKey{Key: pemKey(&ecKey.PublicKey), Algorithm: "ecdsa-sha256"},
+			base64.StdEncoding.EncodeToString(ecASN1), true, false,
+		},
+		{
+			"ecdsa raw",
+			PublicKey{Key: pemKey(&ecKey.PublicKey), Algorithm: "ecdsa-sha256"},
+			base64.RawURLEncoding.EncodeToString(ecRaw), true, false,
+		},
+		{
+			"invalid signature encoding",
+			PublicKey{Key: pemKey(&ecKey.PublicKey), Algorithm: "ecdsa-sha256"},
+			"!", false, true,
+		},
+	} {
+		key := tt.key
+		r := MatchRule{Type: PublicKeySignature, PublicKey: &key, Parameter: Argument{Source: "header", Name: "X-Signature"}}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+		if len(c.errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.desc, c.errs)
+			continue
+		}
+
+		req := &Request{
+			ID:      "test",
+			Headers: map[string]interface{}{"X-Signature": tt.signature, "X-Signature-Timestamp": "1600000000"},
+			Body:    body,
+		}
+
+		ok, err := r.Evaluate(req)
+		if ok != tt.ok || IsSignatureError(err) != tt.sigErr {
+			t.Errorf("%s: expected %#v (signature error %t), got %#v (%v)", tt.desc, tt.ok, tt.sigErr, ok, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		key      *PublicKey
+		errMatch string
+	}{
+		{"missing public key", nil, "match.public-key: missing public key"},
+		{"missing key", &PublicKey{Algorithm: "ed25519"}, "exactly one of key, key-file or key-secret must be set"},
+		{"wrong key type", &PublicKey{Key: pemKey(&ecKey.PublicKey), Algorithm: "rsa-sha256"}, "match.public-key.algorithm: algorithm \"rsa-sha256\" can not be used"},
+		{"unsupported algorithm", &PublicKey{Key: pemKey(&ecKey.PublicKey), Algorithm: "dsa"}, "unsupported algorithm \"dsa\""},
+		{"invalid key", &PublicKey{Key: "not a key", Algorithm: "ed25519"}, "public key is neither PEM, base64 nor hex encoded"},
+	} {
+		r := MatchRule{Type: PublicKeySignature, PublicKey: tt.key}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+		if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.desc, tt.errMatch, c.errs)
+		}
+	}
+}
+
+func TestMatchRuleJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+
+	dir, err := ioutil.TempDir("", "hooks-jwt-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwks := filepath.Join(dir, "jwks.json")
+	jwksData := fmt.Sprintf(`{"keys": [{"kty": "oct", "k": "c2VjcmV0"}, {"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q}, {"kty": "RSA", "kid": "rsa", "n": %q, "e": "AQAB"}]}`,
+		enc(ecKey.X.Bytes()), enc(ecKey.Y.Bytes()), enc(rsaKey.N.Bytes()))
+	if err := ioutil.WriteFile(jwks, []byte(jwksData), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(alg, kid string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := enc(header) + "." + enc(payload)
+		digest := sha256.Sum256([]byte(signed))
+
+		var sig []byte
+		switch alg {
+		case "HS256":
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(signed))
+			sig = mac.Sum(nil)
+		case "RS256":
+			sig, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		case "ES256":
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, ecKey, digest[:])
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signed + "." + enc(sig)
+	}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "deployer", "iss": "idp", "aud": []string{"webhook"}, "exp": now + 60, "nbf": now - 60}
+
+	for _, tt := range []struct {
+		desc   string
+		config string
+		token  string
+		ok     bool
+		sigErr bool
+	}{
+		{"hmac", `{type: jwt, secret: secret, jwt: {issuer: idp, audience: webhook}}`, sign("HS256", "", valid), true, false},
+		{"hmac wrong secret", `{type: jwt, secret: other}`, sign("HS256", "", valid), false, true},
+		{"jwks rsa", `{type: jwt, jwt: {jwks-file: ` + jwks + `}}`, sign("RS256", "rsa", valid), true, false},
+		{"jwks ecdsa", `{type: jwt, jwt: {jwks-file: ` + jwks + `}}`, sign("ES256", "ec", valid), true, false},
+		{"jwks wrong kid", `{type: jwt, jwt: {jwks-file: ` + jwks + `}}`, sign("ES256", "rsa", valid), false, true},
+		{"algorithm not allowed", `{type: jwt, secret: secret, jwt: {algorithms: [RS256]}}`, sign("HS256", "", valid), false, true},
+		{"alg none", `{type: jwt, secret: secret}`, enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(`{}`)) + ".", false, true},
+		{"expired", `{type: jwt, secret: secret}`, sign("HS256", "", map[string]interface{}{"exp": now - 60}), false, true},
+		{"expired within leeway", `{type: jwt, secret: secret, jwt: {leeway: 2m}}`, sign("HS256", "", map[string]interface{}{"exp": now - 60}), true, false},
+		{"not yet valid", `{type: jwt, secret: secret}`, sign("HS256", "", map[string]interface{}{"nbf": now + 60}), false, true},
+		{"wrong issuer", `{type: jwt, secret: secret, jwt: {issuer: other}}`, sign("HS256", "", valid), false, true},
+		{"wrong audience", `{type: jwt, secret: secret, jwt: {audience: other}}`, sign("HS256", "", valid), false, true},
+		{"malformed", `{type: jwt, secret: secret}`, "abc", false, true},
+		{"missing", `{type: jwt, secret: secret}`, "", false, true},
+		{"hmac without secrets", `{type: jwt, jwt: {jwks-file: ` + jwks + `}}`, sign("HS256", "", valid), false, true},
+		{"rsa without keys", `{type: jwt, secret: secret}`, sign("RS256", "rsa", valid), false, true},
+		{"exp required", `{type: jwt, secret: secret, jwt: {require-exp: true}}`, sign("HS256", "", valid), true, false},
+		{"missing exp", `{type: jwt, secret: secret, jwt: {require-exp: true}}`, sign("HS256", "", map[string]interface{}{"sub": "deployer"}), false, true},
+	} {
+		var r MatchRule
+		if err := yaml.Unmarshal([]byte(tt.config), &r); err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+		if len(c.errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.desc, c.errs)
+			continue
+		}
+
+		req := &Request{ID: "test", Headers: map[string]interface{}{}}
+		if tt.token != "" {
+			req.Headers["Authorization"] = "Bearer " + tt.token
+		}
+
+		ok, err := r.Evaluate(req)
+		if ok != tt.ok || IsSignatureError(err) != tt.sigErr {
+			t.Errorf("%s: expected %#v (signature error %t), got %#v (%v)", tt.desc, tt.ok, tt.sigErr, ok, err)
+		}
+
+		if err != nil && tt.token != "" && strings.Contains(err.Error(), tt.token) {
+			t.Errorf("%s: error discloses token: %v", tt.desc, err)
+		}
+
+		if ok {
+			a := Argument{Source: SourceClaims, Name: "sub"}
+			if sub, err := a.Get(req); tt.desc == "hmac" && (err != nil || sub != "deployer") {
+				t.Errorf("%s: expected claim sub %q, got %q (%v)", tt.desc, "deployer", sub, err)
+			}
+		}
+	}
+
+	var r MatchRule
+	if err := yaml.Unmarshal([]byte(`{type: jwt, jwt: {algorithms: [none], jwks-file: `+filepath.Join(dir, "missing")+`}}`), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &configChecker{hook: "test"}
+	r.prepare(c, "match")
+	if len(c.errs) != 2 {
+		t.Errorf("expected algorithm and jwks-file errors, got: %v", c.errs)
+	}
+
+	for _, config := range []string{`{type: jwt}`, `{type: jwt, jwt: {issuer: idp}}`} {
+		var r MatchRule
+		if err := yaml.Unmarshal([]byte(config), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+		if len(c.errs) != 1 || !strings.Contains(c.errs[0].Error(), "match.jwt: missing key") {
+			t.Errorf("%s: expected missing key error, got: %v", config, c.errs)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	const hash = "$2a$04$.M0aBY/ZkbBh8XXFqqrfqOU.CenT7NOu9ERdzPr9eSFj/yMQxUkNW" // "secret"
+
+	dir, err := ioutil.TempDir("", "hooks-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	htpasswd := filepath.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte("# users\nalice:"+hash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Auth{
+		Basic:        []BasicAuthUser{{Username: "bob", Password: hash}},
+		HtpasswdFile: htpasswd,
+		BearerTokens: []RuleSecret{{Value: "token"}, {Value: "old", NotAfter: "2000-01-01"}},
+	}
+
+	c := &configChecker{hook: "test"}
+	a.prepare(c, "auth")
+	if len(c.errs) != 0 {
+		t.Fatalf("unexpected errors: %v", c.errs)
+	}
+
+	for _, tt := range []struct {
+		desc  string
+		setup func(r *http.Request)
+		ok    bool
+	}{
+		{"basic", func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, true},
+		{"htpasswd", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, true},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("bob", "wrong") }, false},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("eve", "secret") }, false},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, true},
+		{"expired bearer", func(r *http.Request) { r.Header.Set("Authorization", "bearer old") }, false},
+		{"wrong bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, false},
+		{"none", func(r *http.Request) {}, false},
+	} {
+		r, _ := http.NewRequest("POST", "/hooks/test", nil)
+		tt.setup(r)
+
+		if ok := a.Authenticate(r); ok != tt.ok {
+			t.Errorf("%s: expected %t, got %t", tt.desc, tt.ok, ok)
+		}
+	}
+
+	// Unknown users are compared against a hash as costly as the users'.
+	slow, err := bcrypt.GenerateFromPassword([]byte("secret"), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	costly := &Auth{Basic: []BasicAuthUser{{Username: "bob", Password: hash}, {Username: "carol", Password: string(slow)}}}
+	costly.prepare(&configChecker{hook: "test"}, "auth")
+	if cost, err := bcrypt.Cost(costly.dummyHash); cost != 6 || err != nil {
+		t.Errorf("expected dummy hash of cost 6, got %d (%v)", cost, err)
+	}
+
+	expected := []string{`Basic realm="webhook"`, `Bearer realm="webhook"`}
+	if challenges := a.Challenges(); !reflect.DeepEqual(challenges, expected) {
+		t.Errorf("expected challenges %#v, got %#v", expected, challenges)
+	}
+
+	for _, tt := range []struct {
+		desc     string
+		auth     *Auth
+		errMatch string
+	}{
+		{"plain password", &Auth{Basic: []BasicAuthUser{{Username: "bob", Password: "secret"}}}, `auth.basic[0]: password of user "bob" must be a bcrypt hash`},
+		{"missing htpasswd", &Auth{HtpasswdFile: filepath.Join(dir, "missing")}, "auth.htpasswd-file"},
+		{"empty", &Auth{}, "auth: no users or bearer tokens configured"},
+	} {
+		c := &configChecker{hook: "test"}
+		tt.auth.prepare(c, "auth")
+		if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.desc, tt.errMatch, c.errs)
+		}
+	}
+}
+
+func TestHooksLoadFromFileIPSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks-ip-sets-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := filepath.Join(dir, "meta.json")
+	if err := ioutil.WriteFile(meta, []byte(`{"hooks": ["192.30.252.0/22", "2a0a:a440::/29"], "web": ["10.0.0.0/8"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	text := filepath.Join(dir, "ranges.txt")
+	if err := ioutil.WriteFile(text, []byte("# office\n203.0.113.7\n\n2001:db8::1 # vpn\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `ip-sets:
+  github:
+    file: ` + meta + `
+    expression: $.hooks
+  office:
+    file: ` + text + `
+  local:
+    ranges: [127.0.0.1, "::1"]
+hooks:
+- id: ip-sets
+  trigger-rule:
+    match:
+      type: ip-whitelist
+      ip-set: github office
+      ip-range: 198.51.100.0/24
+`
+
+	path := filepath.Join(dir, "hooks.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Hooks{}
+	if err := h.LoadFromFile(path, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rule := h.Match("ip-sets").TriggerRule.Match
+
+	for _, tt := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"192.30.253.1:1234", true},
+		{"[2a0a:a440::1]:1234", true},
+		{"203.0.113.7:1234", true},
+		{"203.0.113.8:1234", false},
+		{"[2001:db8::1]:1234", true},
+		{"[2001:db8::2]:1234", false},
+		{"198.51.100.1:1234", true},
+		{"10.0.0.1:1234", false},
+		{"127.0.0.1:1234", false},
+	} {
+		ok, err := rule.Evaluate(&Request{RawRequest: &http.Request{RemoteAddr: tt.addr}})
+		if ok != tt.ok || err != nil {
+			t.Errorf("%s: expected %t, got %t (%v)", tt.addr, tt.ok, ok, err)
+		}
+	}
+
+	// Changes to the file are picked up.
+	if err := ioutil.WriteFile(text, []byte("203.0.113.8\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(text, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	interval := ipSetCheckInterval
+	ipSetCheckInterval = 0
+	defer func() { ipSetCheckInterval = interval }()
+
+	if ok, _ := rule.Evaluate(&Request{RawRequest: &http.Request{RemoteAddr: "203.0.113.8:1234"}}); !ok {
+		t.Error("reloaded IP set does not contain the new address")
+	}
+	if ok, _ := rule.Evaluate(&Request{RawRequest: &http.Request{RemoteAddr: "203.0.113.7:1234"}}); ok {
+		t.Error("reloaded IP set still contains the removed address")
+	}
+
+	for _, tt := range []struct {
+		desc, config, errMatch string
+	}{
+		{"undefined set", `{"hooks": [{"id": "a", "trigger-rule": {"match": {"type": "ip-whitelist", "ip-set": "missing"}}}]}`, `hook "a": trigger-rule.match.ip-set: undefined IP set "missing"`},
+		{"invalid range", `{"ip-sets": {"bad": {"ranges": ["300.0.0.1"]}}, "hooks": []}`, `ip-sets.bad: invalid IP address "300.0.0.1"`},
+		{"short mapped range", `{"ip-sets": {"bad": {"ranges": ["::ffff:0:0/95"]}}, "hooks": []}`, `ip-sets.bad: invalid IPv4-mapped range "::ffff:0:0/95": prefix must be at least /96`},
+		{"not an array", `{"ip-sets": {"bad": {"file": "` + meta + `"}}, "hooks": []}`, `ip-sets.bad: ` + meta + `: ranges must be a JSON array of strings`},
+	} {
+		if err := ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := (&Hooks{}).LoadFromFile(path, false)
+		if err == nil || !strings.Contains(err.Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.desc, tt.errMatch, err)
+		}
+	}
+}
+
+func TestIPSet(t *testing.T) {
+	for _, tt := range []struct {
+		ranges []string
+		ip     string
+		ok     bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3", false},
+		{[]string{"::ffff:0:0/96"}, "192.0.2.1", true},
+		{[]string{"::ffff:0:0/96"}, "2001:db8::1", false},
+		{[]string{"::ffff:10.0.0.0/104"}, "10.1.2.3", true},
+		{[]string{"::ffff:10.0.0.0/104"}, "::ffff:10.1.2.3", true},
+		{[]string{"::ffff:10.0.0.0/104"}, "11.1.2.3", false},
+		{[]string{"::ffff:10.0.0.1/128"}, "10.0.0.1", true},
+		{[]string{"::ffff:10.0.0.1/128"}, "10.0.0.2", false},
+	} {
+		s := &IPSet{Ranges: tt.ranges}
+		if err := s.load(); err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.ranges, err)
+			continue
+		}
+
+		if ok := s.Contains(net.ParseIP(tt.ip)); ok != tt.ok {
+			t.Errorf("%v contains %s: expected %t, got %t", tt.ranges, tt.ip, tt.ok, ok)
+		}
+	}
+}
+
+func TestMatchRuleComparisons(t *testing.T) {
+	req := &Request{
+		Body:    []byte(`{"additions": 120, "ratio": 0.5, "ref": "refs/heads/main", "labels": ["bug", "urgent"], "count": "12"}`),
+		Headers: map[string]interface{}{"X-Event": "push"},
+	}
+	if err := req.ParseJSONPayload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		config string
+		ok     bool
+		err    bool
+	}{
+		{`{type: lt, value: 500, parameter: {source: payload, name: additions}}`, true, false},
+		{`{type: lt, value: 100, parameter: {source: payload, name: additions}}`, false, false},
+		{`{type: le, value: 120, parameter: {source: payload, name: additions}}`, true, false},
+		{`{type: gt, value: 120, parameter: {source: payload, name: additions}}`, false, false},
+		{`{type: ge, value: 120, parameter: {source: payload, name: additions}}`, true, false},
+		{`{type: gt, value: 0.25, parameter: {source: payload, name: ratio}}`, true, false},
+		{`{type: gt, value: 9, parameter: {source: payload, name: count}}`, true, false},
+		{`{type: gt, value: 1, parameter: {source: payload, name: ref}}`, false, false},
+		{`{type: gt, value: 1, parameter: {source: payload, name: missing}}`, false, true},
+		{`{type: in, values: [refs/heads/main, refs/heads/release], parameter: {source: payload, name: ref}}`, true, false},
+		{`{type: in, values: [refs/heads/release], parameter: {source: payload, name: ref}}`, false, false},
+		{`{type: in, values: [120, 121], parameter: {source: payload, name: additions}}`, true, false},
+		{`{type: not-in, values: [pull_request], parameter: {source: header, name: X-Event}}`, true, false},
+		{`{type: not-in, values: [push], parameter: {source: header, name: X-Event}}`, false, false},
+		{`{type: contains, value: heads, parameter: {source: payload, name: ref}}`, true, false},
+		{`{type: contains, value: urgent, parameter: {source: payload, name: labels}}`, true, false},
+		{`{type: contains, value: urg, parameter: {source: payload, name: labels}}`, false, false},
+		{`{type: prefix, value: refs/heads/, parameter: {source: payload, name: ref}}`, true, false},
+		{`{type: suffix, value: /main, parameter: {source: payload, name: ref}}`, true, false},
+		{`{type: suffix, value: /dev, parameter: {source: payload, name: ref}}`, false, false},
+		{`{type: exists, parameter: {source: payload, name: labels.1}}`, true, false},
+		{`{type: exists, parameter: {source: payload, name: labels.2}}`, false, false},
+		{`{type: exists, parameter: {source: url, name: q}}`, false, false},
+	} {
+		var r MatchRule
+		if err := yaml.Unmarshal([]byte(tt.config), &r); err != nil {
+			t.Fatalf("%s: %v", tt.config, err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+		if len(c.errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.config, c.errs)
+			continue
+		}
+
+		ok, err := r.Evaluate(req)
+		if ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("%s: expected %#v (error %t), got %#v (%v)", tt.config, tt.ok, tt.err, ok, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		rule     MatchRule
+		errMatch string
+	}{
+		{MatchRule{Type: MatchGreaterThan, Value: "many"}, `match.value: "many" is not a number`},
+		{MatchRule{Type: MatchIn}, `match.values: missing values`},
+	} {
+		c := &configChecker{hook: "test"}
+		tt.rule.prepare(c, "match")
+		if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.rule.Type, tt.errMatch, c.errs)
+		}
+	}
+}
+
+func TestRulesExpression(t *testing.T) {
+	req := &Request{
+		Body:    []byte(`{"ref": "refs/heads/main", "commits": [{"id": "a"}, {"id": "b"}], "size": 3}`),
+		Headers: map[string]interface{}{"X-Github-Event": "push", "X-Count": "12"},
+		Query:   map[string]interface{}{"env": "Prod"},
+	}
+	if err := req.ParseJSONPayload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		expr string
+		ok   bool
+		err  bool
+	}{
+		{`payload.ref == "refs/heads/main" && headers["X-GitHub-Event"] in ["push", "release"]`, true, false},
+		{`payload.ref == 'refs/heads/dev' || headers["x-github-event"] == "release"`, false, false},
+		{`!(payload.ref != "refs/heads/main")`, true, false},
+		{`payload.commits[1].id == "b" && payload.commits.0.id == "a"`, true, false},
+		{`len(payload.commits) == 2 && payload.size >= 3 && payload.size < 4`, true, false},
+		{`headers["X-Count"] > 9`, true, false},
+		{`lower(query.env) == "prod"`, true, false},
+		{`query.env not in ["Prod", "Staging"]`, false, false},
+		{`prefix(payload.ref, "refs/heads/") && suffix(payload.ref, "/main")`, true, false},
+		{`contains(payload.ref, "heads") && contains(["a", "b"], "b")`, true, false},
+		{`matches(payload.ref, "^refs/heads/(main|master)$")`, true, false},
+		{`exists(payload.missing) || payload.missing.deeper == null`, true, false},
+		{`"X-Github-Event" in headers && "ref" in payload`, true, false},
+		{`payload.ref`, false, true},
+		{`!payload.size`, false, true},
+		{`payload.size == 3 && payload.ref`, false, true},
+	} {
+		var r Rules
+		if err := yaml.Unmarshal([]byte("expression: "+strconv.Quote(tt.expr)), &r); err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "trigger-rule")
+		if len(c.errs) != 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.expr, c.errs)
+			continue
+		}
+
+		ok, err := r.Evaluate(req)
+		if ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("%s: expected %#v (error %t), got %#v (%v)", tt.expr, tt.ok, tt.err, ok, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		expr     string
+		errMatch string
+	}{
+		{``, `empty expression`},
+		{`payload.ref ==`, `at offset 14: unexpected end of expression`},
+		{`payload.ref == "main`, `at offset 15: unterminated string`},
+		{`payloads.ref == "main"`, `at offset 0: unknown identifier "payloads"`},
+		{`upper(payload.ref) == "MAIN"`, `at offset 0: unknown function "upper"`},
+		{`prefix(payload.ref)`, `prefix expects 2 arguments, found 1`},
+		{`matches(payload.ref, "(")`, `missing closing )`},
+		{`payload.ref == "a" "b"`, `at offset 19: unexpected "b"`},
+		{`payload.ref # 1`, `at offset 12: unexpected character '#'`},
+	} {
+		r := Rules{Expression: &Expression{src: tt.expr}}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "trigger-rule")
+		if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.errMatch) || !strings.Contains(c.errs[0].Error(), "trigger-rule.expression") {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.expr, tt.errMatch, c.errs)
+		}
+	}
+	// Expressions are only compiled when the hooks are prepared.
+	var e Expression
+	if err := json.Unmarshal([]byte(`"payload.ref == \"main\""`), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Evaluate(&Request{}); err == nil || !strings.Contains(err.Error(), "not compiled") {
+		t.Errorf("expected not compiled error, got: %v", err)
+	}
+}
+
+func TestRulesTrace(t *testing.T) {
+	req := &Request{
+		Body:    []byte(`{"ref": "refs/heads/main", "token": "s3cret"}`),
+		Headers: map[string]interface{}{"X-Signature": "abc"},
+	}
+	if err := req.ParseJSONPayload(); err != nil {
+		t.Fatal(err)
+	}
+
+	var r Rules
+	err := yaml.Unmarshal([]byte(`
+and:
+- match: {type: value, value: refs/heads/main, parameter: {source: payload, name: ref}}
+- not:
+    expression: 'payload.token == "guess"'
+- or:
+  - match: {type: payload-hmac-sha256, secret: key, parameter: {source: header, name: X-Signature}}
+  - match: {type: value, value: s3cret, parameter: {source: payload, name: token, sensitive: true}}
+`), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &configChecker{hook: "test"}
+	r.prepare(c, "trigger-rule")
+	if len(c.errs) != 0 {
+		t.Fatalf("unexpected errors: %v", c.errs)
+	}
+
+	req.AllowSignatureErrors = true
+
+	ok, trace, err := r.Trace(req)
+	if !ok || err != nil {
+		t.Fatalf("expected rules to match, got %t (%v)", ok, err)
+	}
+
+	expected := `and: true
+  match value payload ref="refs/heads/main": true
+  not: true
+    expression "payload.token == \"guess\"": false
+  or: true
+    match payload-hmac-sha256 header X-Signature="[redacted]": false (error: invalid payload signatures [abc])
+    match value payload token="[redacted]": true`
+	if trace.String() != expected {
+		t.Errorf("unexpected trace:\nexpected:\n%s\ngot:\n%s", expected, trace)
+	}
+
+	if req.trace != nil {
+		t.Error("trace left on the request")
+	}
+
+	if ok, trace, _ := (Rules{}).Trace(req); ok || trace == nil || trace.Rule != "empty" {
+		t.Errorf("unexpected trace of empty rules: %v", trace)
+	}
+}
+
+func TestHooksLoadFromFileNamedRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks-rules-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rulesFile := `main-branch:
+  match: {type: value, value: refs/heads/main, parameter: {source: payload, name: ref}}
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(rulesFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `rules-file: rules.yaml
+rules:
+  github-main:
+    and:
+    - match: {type: value, value: push, parameter: {source: header, name: X-Github-Event}}
+    - ref: main-branch
+hooks:
+- id: deploy
+  trigger-rule:
+    ref: github-main
+- id: release
+  trigger-rule:
+    not:
+      ref: main-branch
+`
+	path := filepath.Join(dir, "hooks.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Hooks{}
+	rulesPath, err := h.LoadFromFileWithRulesFile(path, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := filepath.Join(dir, "rules.yaml"); rulesPath != expected {
+		t.Errorf("expected rules file %s, got %s", expected, rulesPath)
+	}
+
+	for _, tt := range []struct {
+		id, event, ref string
+		ok             bool
+	}{
+		{"deploy", "push", "refs/heads/main", true},
+		{"deploy", "push", "refs/heads/dev", false},
+		{"deploy", "release", "refs/heads/main", false},
+		{"release", "push", "refs/heads/main", false},
+		{"release", "push", "refs/heads/dev", true},
+	} {
+		req := &Request{
+			Headers: map[string]interface{}{"X-Github-Event": tt.event},
+			Payload: map[string]interface{}{"ref": tt.ref},
+		}
+
+		ok, err := h.Match(tt.id).TriggerRule.Evaluate(req)
+		if ok != tt.ok || err != nil {
+			t.Errorf("%s %s %s: expected %t, got %t (%v)", tt.id, tt.event, tt.ref, tt.ok, ok, err)
+		}
+	}
+
+	req := &Request{Payload: map[string]interface{}{"ref": "refs/heads/main"}}
+	if _, trace, _ := h.Match("release").TriggerRule.Trace(req); !strings.Contains(trace.String(), "not: false\n  ref main-branch: true\n    match value") {
+		t.Errorf("unexpected trace:\n%s", trace)
+	}
+
+	for _, tt := range []struct {
+		config   string
+		errMatch []string
+	}{
+		{
+			"rules:\n  a: {ref: b}\n  b: {or: [{ref: c}, {ref: a}]}\n  c: {ref: a}\n  d: {ref: d}\nhooks:\n- id: x\n  trigger-rule: {ref: a}\n",
+			[]string{`rules.a: reference cycle a -> b -> c -> a`, `rules.a: reference cycle a -> b -> a`, `rules.d: reference cycle d -> d`},
+		},
+		{
+			"rules:\n  a: {ref: missing}\nhooks:\n- id: x\n  trigger-rule: {and: [{ref: a}, {ref: other}]}\n",
+			[]string{`rules.a.ref: undefined rule "missing"`, `hook "x": trigger-rule.and[1].ref: undefined rule "other"`},
+		},
+		{
+			"rules-file: missing.yaml\nhooks: []\n",
+			[]string{`error loading rules file`},
+		},
+	} {
+		if err := ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := (&Hooks{}).LoadFromFile(path, false)
+		for _, m := range tt.errMatch {
+			if err == nil || !strings.Contains(err.Error(), m) {
+				t.Errorf("expected error containing %q, got: %v", m, err)
+			}
+		}
+	}
+}
+
+func TestMatchRuleTimeWindow(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+
+	config := `{type: time-window, time-window: {
+		days: [mon-fri, sun],
+		times: ["09:00-12:00", "22:00-02:00"],
+		timezone: Europe/Berlin,
+		blackouts: [
+			{from: 2024-12-20, to: 2025-01-03, reason: holiday freeze},
+			{from: "2024-06-12T10:00:00Z", to: "2024-06-12T10:30:00Z"},
+			{from: 2024-06-14}
+		]
+	}}`
+
+	var r MatchRule
+	if err := yaml.Unmarshal([]byte(config), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &configChecker{hook: "test"}
+	r.prepare(c, "match")
+	if len(c.errs) != 0 {
+		t.Fatalf("unexpected errors: %v", c.errs)
+	}
+
+	for _, tt := range []struct {
+		now    string
+		ok     bool
+		reason string
+	}{
+		{"2024-06-11T09:30:00+02:00", true, ""},                                 // Tuesday
+		{"2024-06-11T07:30:00Z", true, ""},                                      // 09:30 in Berlin
+		{"2024-06-11T12:00:00+02:00", false, "outside of the time window"},      // end is exclusive
+		{"2024-06-11T23:15:00+02:00", true, ""},                                 // spans midnight
+		{"2024-06-12T01:59:00+02:00", true, ""},                                 // spans midnight
+		{"2024-06-15T10:00:00+02:00", false, "outside of the time window"},      // Saturday
+		{"2024-06-15T01:00:00+02:00", true, ""},                                 // Friday night
+		{"2024-06-15T23:00:00+02:00", false, "outside of the time window"},      // Saturday night
+		{"2024-06-16T01:00:00+02:00", false, "outside of the time window"},      // Saturday night
+		{"2024-06-17T01:00:00+02:00", true, ""},                                 // Sunday night
+		{"2024-06-16T10:00:00+02:00", true, ""},                                 // Sunday
+		{"2024-12-23T10:00:00+01:00", false, "blackout period: holiday freeze"}, // freeze
+		{"2025-01-03T23:59:00+01:00", false, "blackout period: holiday freeze"}, // last day of freeze
+		{"2025-01-06T10:00:00+01:00", true, ""},                                 // after freeze
+		{"2024-06-12T10:15:00Z", false, "blackout period"},                      // RFC 3339 blackout
+		{"2024-06-14T11:00:00+02:00", false, "blackout period"},                 // single day blackout
+	} {
+		now, err := time.Parse(time.RFC3339, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		timeNow = func() time.Time { return now }
+
+		req := &Request{}
+		ok, err := r.Evaluate(req)
+		if ok != tt.ok || err != nil || req.TimeWindowMismatch != tt.reason {
+			t.Errorf("%s: expected %t (%q), got %t (%q, %v)", tt.now, tt.ok, tt.reason, ok, req.TimeWindowMismatch, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		config   string
+		errMatch string
+	}{
+		{`{type: time-window}`, `match.time-window: missing time window`},
+		{`{type: time-window, time-window: {days: [mon-fry]}}`, `match.time-window.days[0]: invalid day "mon-fry"`},
+		{`{type: time-window, time-window: {times: ["9-17"]}}`, `match.time-window.times[0]: invalid time range "9-17"`},
+		{`{type: time-window, time-window: {times: ["09:00-09:00"]}}`, `empty time range`},
+		{`{type: time-window, time-window: {timezone: Mars/Olympus}}`, `match.time-window.timezone`},
+		{`{type: time-window, time-window: {blackouts: [{from: 2024-12-20, to: 2024-12-01}]}}`, `match.time-window.blackouts[0]: to is before from`},
+		{`{type: time-window, time-window: {blackouts: [{to: 2024-12-01}]}}`, `match.time-window.blackouts[0].from: missing date`},
+	} {
+		var r MatchRule
+		if err := yaml.Unmarshal([]byte(tt.config), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "match")
+		if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.config, tt.errMatch, c.errs)
+		}
+	}
+}
+
+func TestTimeWindowMismatch(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+
+	// Saturday, outside of the window.
+	now := time.Date(2024, 6, 15, 10, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	closed := `{match: {type: time-window, time-window: {days: [mon-fri], timezone: UTC}}}`
+	open := `{match: {type: time-window, time-window: {days: [sat], timezone: UTC}}}`
+	good := `{match: {type: value, value: a, parameter: {source: header, name: a}}}`
+	bad := `{match: {type: value, value: b, parameter: {source: header, name: a}}}`
+
+	for _, tt := range []struct {
+		config   string
+		ok       bool
+		mismatch bool
+	}{
+		{closed, false, true},
+		{open, true, false},
+		{`{and: [` + closed + `, ` + good + `]}`, false, true},
+		{`{and: [` + good + `, ` + closed + `]}`, false, true},
+		{`{and: [` + closed + `, ` + bad + `]}`, false, false},
+		{`{and: [` + bad + `, ` + closed + `]}`, false, false},
+		{`{or: [` + closed + `, ` + bad + `]}`, false, true},
+		{`{or: [` + closed + `, ` + good + `]}`, true, false},
+		{`{and: [{or: [` + closed + `, ` + good + `]}, ` + bad + `]}`, false, false},
+		{`{not: ` + closed + `}`, true, false},
+		{`{and: [{not: ` + closed + `}, ` + bad + `]}`, false, false},
+		{`{and: [{not: ` + open + `}, ` + good + `]}`, false, false},
+	} {
+		var r Rules
+		if err := yaml.Unmarshal([]byte(tt.config), &r); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		r.prepare(c, "trigger-rule")
+		if len(c.errs) != 0 {
+			t.Fatalf("%s: unexpected errors: %v", tt.config, c.errs)
+		}
+
+		req := &Request{Headers: map[string]interface{}{"A": "a"}}
+		ok, err := r.Evaluate(req)
+		if ok != tt.ok || err != nil || (req.TimeWindowMismatch != "") != tt.mismatch {
+			t.Errorf("%s: expected %t (mismatch %t), got %t (%q, %v)", tt.config, tt.ok, tt.mismatch, ok, req.TimeWindowMismatch, err)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		reqs   []*http.Request
+		allow  []bool
+	}{
+		{
+			`{requests: 2, interval: 1h}`,
+			[]*http.Request{
+				{RemoteAddr: "198.51.100.1:1"}, {RemoteAddr: "198.51.100.2:1"}, {RemoteAddr: "198.51.100.3:1"},
+			},
+			[]bool{true, true, false},
+		},
+		{
+			`{requests: 1, interval: 1h, key: client-ip}`,
+			[]*http.Request{
+				{RemoteAddr: "198.51.100.1:1"}, {RemoteAddr: "198.51.100.1:2"}, {RemoteAddr: "198.51.100.2:1"},
+			},
+			[]bool{true, false, true},
+		},
+		{
+			`{requests: 1, interval: 1h, key: argument, parameter: {source: header, name: X-Sender}}`,
+			[]*http.Request{
+				{Header: http.Header{"X-Sender": {"a"}}, URL: &url.URL{}},
+				{Header: http.Header{"X-Sender": {"b"}}, URL: &url.URL{}},
+				{Header: http.Header{"X-Sender": {"a"}}, URL: &url.URL{}},
+			},
+			[]bool{true, true, false},
+		},
+	} {
+		var l RateLimit
+		if err := yaml.Unmarshal([]byte(tt.config), &l); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		l.prepare(c, "rate-limit")
+		if len(c.errs) != 0 {
+			t.Fatalf("%s: unexpected errors: %v", tt.config, c.errs)
+		}
+
+		for i, r := range tt.reqs {
+			ok, wait := l.Allow(&Request{RawRequest: r})
+			if ok != tt.allow[i] || ok != (wait == 0) {
+				t.Errorf("%s: request %d: expected %t, got %t (wait %s)", tt.config, i, tt.allow[i], ok, wait)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		config   string
+		errMatch string
+	}{
+		{`{interval: 1m}`, `rate-limit.requests: must be positive`},
+		{`{requests: 1, interval: soon}`, `rate-limit.interval`},
+		{`{requests: 1, key: user}`, `rate-limit.key: unsupported key "user"`},
+		{`{requests: 1, key: argument}`, `rate-limit.parameter: missing parameter`},
+		{`{requests: 1, key: argument, parameter: {source: payload, name: user}}`, `rate-limit.parameter: unsupported source "payload"`},
+	} {
+		var l RateLimit
+		if err := yaml.Unmarshal([]byte(tt.config), &l); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		l.prepare(c, "rate-limit")
+		if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.config, tt.errMatch, c.errs)
+		}
+	}
+}
+
+func TestRateLimitInherit(t *testing.T) {
+	load := func(config string) *RateLimit {
+		var l RateLimit
+		if err := yaml.Unmarshal([]byte(config), &l); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		l.prepare(c, "rate-limit")
+		if len(c.errs) != 0 {
+			t.Fatalf("%s: unexpected errors: %v", config, c.errs)
+		}
+
+		return &l
+	}
+
+	req := &Request{RawRequest: &http.Request{RemoteAddr: "198.51.100.1:1"}}
+
+	old := load(`{requests: 1, interval: 1h}`)
+	if ok, _ := old.Allow(req); !ok {
+		t.Fatal("expected first request to be allowed")
+	}
+
+	for _, tt := range []struct {
+		config string
+		allow  bool
+	}{
+		{`{requests: 1, interval: 1h}`, false},
+		{`{requests: 2, interval: 1h}`, true},
+		{`{requests: 1, interval: 2h}`, true},
+		{`{requests: 1, interval: 1h, key: client-ip}`, true},
+	} {
+		l := load(tt.config)
+		l.Inherit(old)
+
+		if ok, _ := l.Allow(req); ok != tt.allow {
+			t.Errorf("%s: expected %t, got %t", tt.config, tt.allow, ok)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		header http.Header
+		key    string
+		found  bool
+		ttl    time.Duration
+	}{
+		{`{parameter: {source: header, name: X-Delivery}}`, http.Header{"X-Delivery": {"abc"}}, "abc", true, DefaultIdempotencyTTL},
+		{`{parameter: {source: header, name: X-Delivery}, ttl: 1h}`, http.Header{"X-Delivery": {"abc"}}, "abc", true, time.Hour},
+		{`{parameter: {source: header, name: X-Delivery}}`, http.Header{}, "", false, DefaultIdempotencyTTL},
+	} {
+		var k IdempotencyKey
+		if err := yaml.Unmarshal([]byte(tt.config), &k); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		k.prepare(c, "idempotency-key")
+		if len(c.errs) != 0 {
+			t.Fatalf("%s: unexpected errors: %v", tt.config, c.errs)
+		}
+
+		req := &Request{}
+		req.ParseHeaders(tt.header)
+
+		key, found := k.Get(req)
+		if key != tt.key || found != tt.found || k.Duration() != tt.ttl {
+			t.Errorf("%s: expected %q, %t (ttl %s), got %q, %t (ttl %s)", tt.config, tt.key, tt.found, tt.ttl, key, found, k.Duration())
+		}
+	}
+
+	for _, tt := range []struct {
+		config   string
+		errMatch string
+	}{
+		{`{parameter: {source: header, name: X-Delivery}, ttl: soon}`, `idempotency-key.ttl`},
+		{`{parameter: {source: header, name: X-Delivery}, ttl: -1h}`, `idempotency-key.ttl: must be positive`},
+	} {
+		var k IdempotencyKey
+		if err := yaml.Unmarshal([]byte(tt.config), &k); err != nil {
+			t.Fatal(err)
+		}
+
+		c := &configChecker{hook: "test"}
+		k.prepare(c, "idempotency-key")
+		if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.config, tt.errMatch, c.errs)
+		}
+	}
+}
+
+func TestRequestParseValues(t *testing.T) {
+	r := &Request{Body: []byte("a=x&tag=y&tag=z")}
+
+	r.ParseHeaders(http.Header{"X-A": {"x"}, "X-Tag": {"y", "z"}, "X-Empty": {}})
+	r.ParseQuery(url.Values{"a": {"x"}, "tag": {"y", "z"}})
+	if err := r.ParseFormPayload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		got  map[string]interface{}
+		want map[string]interface{}
+	}{
+		{"headers", r.Headers, map[string]interface{}{"X-A": "x", "X-Tag": RepeatedValues{"y", "z"}}},
+		{"query", r.Query, map[string]interface{}{"a": "x", "tag": RepeatedValues{"y", "z"}}},
+		{"form payload", r.Payload, map[string]interface{}{"a": "x", "tag": RepeatedValues{"y", "z"}}},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s: expected %#v, got %#v", tt.desc, tt.want, tt.got)
+		}
+	}
+}
+
+func TestRepeatedValues(t *testing.T) {
+	req := &Request{ID: "test", Body: []byte(`{"a": "z"}`)}
+	req.ParseHeaders(http.Header{
+		"X-Tag":           {"y", "z"},
+		"X-Hub-Signature": {"sha1=b17e04cbb22afa8ffbff8796fc1894ed27badd9e", "sha1=00"},
+	})
+
+	for _, src := range []string{`headers["X-Tag"] == "y"`, `headers["X-Tag"][1] == "z"`, `len(headers["x-tag"]) == 1`} {
+		e, err := NewExpression(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, err := e.Evaluate(req); !ok || err != nil {
+			t.Errorf("%s: expected true, got %t (%v)", src, ok, err)
+		}
+	}
+
+	// Repeated signature headers are checked by their first value.
+	r := MatchRule{Type: "github-signature", Secret: "secret"}
+	if ok, err := r.Evaluate(req); !ok || err != nil {
+		t.Errorf("expected first signature to be verified, got %t (%v)", ok, err)
+	}
+}
+
+func TestMultipartFileArgument(t *testing.T) {
+	r := &Request{}
+	r.AddFile(&File{Field: "upload", Filename: "a.txt", ContentType: "text/plain", Size: 5, Path: "/tmp/a"})
+	r.AddFile(&File{Field: "upload", Filename: "b.json", ContentType: "application/json", Size: 8, Path: "/tmp/b"})
+	r.AddFile(&File{Field: "log.txt", Filename: "c.txt", Path: "/tmp/c"})
+
+	for _, tt := range []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"upload", "/tmp/a", true},
+		{"upload.path", "/tmp/a", true},
+		{"upload.filename", "a.txt", true},
+		{"upload.1", "/tmp/b", true},
+		{"upload.1.content-type", "application/json", true},
+		{"upload.1.size", "8", true},
+		{"log.txt", "/tmp/c", true},
+		{"log.txt.filename", "c.txt", true},
+		// failures
+		{"upload.2", "", false},
+		{"missing", "", false},
+	} {
+		a := Argument{Source: SourceMultipartFile, Name: tt.name}
+
+		value, err := a.Get(r)
+		if (err == nil) != tt.ok || value != tt.value {
+			t.Errorf("%s: expected {value:%#v, ok:%#v}, got {value:%#v, err:%v}", tt.name, tt.value, tt.ok, value, err)
+		}
+	}
+
+	h := &Hook{PassFileToCommand: []Argument{
+		{Source: SourceMultipartFile, Name: "upload.1", EnvName: "UPLOAD"},
+		{Source: SourceMultipartFile, Name: "upload.filename", EnvName: "UPLOAD_NAME"},
+	}}
+
+	files, errs := h.ExtractCommandArgumentsForFile(r)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	expected := []FileParameter{{EnvName: "UPLOAD", Path: "/tmp/b"}, {EnvName: "UPLOAD_NAME", Data: []byte("a.txt")}}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %#v, got %#v", expected, files)
+	}
+}
+
+func TestRequestDecodeBody(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/main"}`)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(body)
+	gw.Close()
+
+	var zl bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	zw.Write(body)
+	zw.Close()
+
+	var fl bytes.Buffer
+	fw, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	fw.Write(body)
+	fw.Close()
+
+	ze, _ := zstd.NewWriter(nil)
+	zs := ze.EncodeAll(body, nil)
+	gzzs := ze.EncodeAll(gz.Bytes(), nil)
+	ze.Close()
+
+	for _, tt := range []struct {
+		encoding string
+		body     []byte
+		max      int64
+		err      string
+	}{
+		{"gzip", gz.Bytes(), 0, ""},
+		{"x-gzip", gz.Bytes(), int64(len(body)), ""},
+		{"deflate", zl.Bytes(), 0, ""},
+		{"deflate", fl.Bytes(), 0, ""},
+		{"zstd", zs, 1024, ""},
+		{"gzip, zstd", gzzs, 1024, ""},
+		{"identity", body, 0, ""},
+		// failures
+		{"gzip", gz.Bytes(), 10, "decoded request body is too large"},
+		{"zstd", zs, 10, "decoded request body is too large"},
+		{"gzip", body, 0, "error decoding gzip request body"},
+		{"br", body, 0, `unsupported content encoding "br"`},
+	} {
+		r := &Request{Body: tt.body}
+
+		err := r.DecodeBody(tt.encoding, tt.max)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error containing %q, got %v", tt.encoding, tt.err, err)
+			}
+			if unsupported := strings.HasPrefix(tt.err, "unsupported"); IsUnsupportedEncodingError(err) != unsupported {
+				t.Errorf("%s: expected unsupported encoding error %t, got %T", tt.encoding, unsupported, err)
+			}
+			if !bytes.Equal(r.Body, tt.body) {
+				t.Errorf("%s: expected body to be kept on error", tt.encoding)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.encoding, err)
+			continue
+		}
+
+		if !bytes.Equal(r.Body, body) || !bytes.Equal(r.RawBody, tt.body) {
+			t.Errorf("%s: expected body %q and raw body %q, got %q and %q", tt.encoding, body, tt.body, r.Body, r.RawBody)
+		}
+	}
+}
+
+func TestMatchRuleSignedBody(t *testing.T) {
+	raw := []byte("compressed")
+	decoded := []byte(`{"a": "z"}`)
+
+	sign := func(b []byte) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(b)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for _, tt := range []struct {
+		signedBody string
+		signature  string
+		rawBody    []byte
+		ok         bool
+	}{
+		{"", sign(raw), raw, true},
+		{"raw", sign(raw), raw, true},
+		{"raw", sign(decoded), raw, false},
+		{"decoded", sign(decoded), raw, true},
+		{"decoded", sign(raw), raw, false},
+		// Bodies that were not compressed are verified as received.
+		{"raw", sign(decoded), nil, true},
+	} {
+		r := MatchRule{
+			Type:       MatchHMACSHA256,
+			Secret:     "secret",
+			SignedBody: tt.signedBody,
+			Parameter:  Argument{Source: SourceHeader, Name: "X-Signature"},
+		}
+
+		req := &Request{
+			Headers: map[string]interface{}{"X-Signature": tt.signature},
+			Body:    decoded,
+			RawBody: tt.rawBody,
+		}
+
+		ok, _ := r.Evaluate(req)
+		if ok != tt.ok {
+			t.Errorf("%q (raw body %q): expected %t, got %t", tt.signedBody, tt.rawBody, tt.ok, ok)
+		}
+
+		if !bytes.Equal(req.Body, decoded) {
+			t.Errorf("%q: expected the decoded body to be restored, got %q", tt.signedBody, req.Body)
+		}
+	}
+
+	c := &configChecker{hook: "test"}
+	r := MatchRule{Type: MatchHMACSHA256, SignedBody: "compressed"}
+	r.prepare(c, "trigger-rule.match")
+	if len(c.errs) == 0 || !strings.Contains(c.errs[0].Error(), `trigger-rule.match.signed-body: unsupported signed body "compressed"`) {
+		t.Errorf("expected signed-body error, got %v", c.errs)
+	}
+}
+
+func TestHookPrepareSizeLimits(t *testing.T) {
+	for _, tt := range []struct {
+		config   string
+		errMatch string
+	}{
+		{`{id: test, max-body-size: -2}`, `max-body-size: must be -1 or more`},
+		{`{id: test, max-multipart-files: -1}`, `max-multipart-files: must not be negative`},
+		{`{id: test, max-multipart-file-size: -1}`, `max-multipart-file-size: must not be negative`},
+	} {
+		var h Hook
+		if err := yaml.Unmarshal([]byte(tt.config), &h); err != nil {
+			t.Fatal(err)
+		}
+
+		errs := h.prepare(nil)
+		if len(errs) == 0 || !strings.Contains(errs[0].Error(), tt.errMatch) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.config, tt.errMatch, errs)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package hook
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultIdempotencyTTL is how long the response to a request with an
+// idempotency key is remembered, unless the hook sets a TTL.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// IdempotencyKey makes a hook remember the responses to requests by a key
+// taken from the request, such as a delivery ID header, so that repeated
+// deliveries get the original response instead of triggering the hook again.
+type IdempotencyKey struct {
+	// Parameter is the request value holding the key.
+	Parameter Argument `json:"parameter"`
+	// TTL is how long the response is remembered, such as "1h". It defaults
+	// to DefaultIdempotencyTTL.
+	TTL string `json:"ttl,omitempty"`
+
+	ttl time.Duration
+}
+
+// prepare parses the key's TTL, reporting problems at path.
+func (k *IdempotencyKey) prepare(c *configChecker, path string) {
+	k.Parameter.prepare(c, path+".parameter")
+
+	k.ttl = DefaultIdempotencyTTL
+	if k.TTL == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(k.TTL)
+	if err == nil && d <= 0 {
+		err = errors.New("must be positive")
+	}
+	if err != nil {
+		c.add(path+".ttl", err)
+		return
+	}
+
+	k.ttl = d
+}
+
+// Get returns the key of the request. It returns false if the request has no
+// key.
+func (k *IdempotencyKey) Get(req *Request) (string, bool) {
+	v, err := k.Parameter.Get(req)
+	if err != nil || v == "" {
+		return "", false
+	}
+
+	return v, true
+}
+
+// Duration returns how long the response to the request is remembered.
+func (k *IdempotencyKey) Duration() time.Duration {
+	if k.ttl == 0 {
+		return DefaultIdempotencyTTL
+	}
+
+	return k.ttl
+}
@@ -0,0 +1,317 @@
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oliveagle/jsonpath"
+)
+
+// ipSetCheckInterval is the minimum interval between checks for changes to
+// the file of an IP set.
+var ipSetCheckInterval = 5 * time.Second
+
+// IPSet is a named set of IP ranges that can be referenced by ip-whitelist
+// rules. The ranges are listed in the hooks file or loaded from a file, such
+// as a saved copy of the hook source ranges published by a Git forge. A file
+// is reloaded when it changes.
+type IPSet struct {
+	// Ranges lists IP addresses and ranges in CIDR notation.
+	Ranges []string `json:"ranges,omitempty"`
+	// File is the path to a file of ranges. A JSON file holds an array of
+	// ranges, or the ranges are selected by Expression; any other file
+	// lists one range per line, ignoring empty lines and # comments.
+	File string `json:"file,omitempty"`
+	// Expression is a JSONPath expression selecting the ranges in a JSON
+	// file, ie. "$.hooks" for the output of GitHub's meta API.
+	Expression string `json:"expression,omitempty"`
+
+	jpath     *jsonpath.Compiled
+	mu        sync.RWMutex
+	ranges    *ipTrie
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// prepare loads the set's ranges.
+func (s *IPSet) prepare(c *configChecker, path string) {
+	if len(s.Ranges) == 0 && s.File == "" {
+		c.add(path, errors.New("no ranges or file configured"))
+		return
+	}
+
+	if s.Expression != "" {
+		pat, err := jsonpath.Compile(s.Expression)
+		if err != nil {
+			c.add(path+".expression", err)
+			return
+		}
+
+		s.jpath = pat
+	}
+
+	if err := s.load(); err != nil {
+		c.add(path, err)
+	}
+}
+
+// load builds the set from its ranges and file.
+func (s *IPSet) load() error {
+	t := new(ipTrie)
+
+	for _, r := range s.Ranges {
+		if err := t.insert(r); err != nil {
+			return err
+		}
+	}
+
+	var modTime time.Time
+
+	if s.File != "" {
+		fi, err := os.Stat(s.File)
+		if err != nil {
+			return err
+		}
+
+		modTime = fi.ModTime()
+
+		ranges, err := s.readFile()
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.File, err)
+		}
+
+		for _, r := range ranges {
+			if err := t.insert(r); err != nil {
+				return fmt.Errorf("%s: %w", s.File, err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.ranges = t
+	s.modTime = modTime
+	s.lastCheck = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// readFile reads the ranges listed in the set's file.
+func (s *IPSet) readFile() ([]string, error) {
+	b, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Expression == "" && !strings.HasSuffix(strings.ToLower(s.File), ".json") {
+		var ranges []string
+
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			line := sc.Text()
+			if i := strings.IndexByte(line, '#'); i != -1 {
+				line = line[:i]
+			}
+
+			if line = strings.TrimSpace(line); line != "" {
+				ranges = append(ranges, line)
+			}
+		}
+
+		return ranges, sc.Err()
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	if s.Expression != "" {
+		pat, err := s.jpath, error(nil)
+		if pat == nil {
+			if pat, err = jsonpath.Compile(s.Expression); err != nil {
+				return nil, err
+			}
+		}
+
+		v, err = pat.Lookup(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("ranges must be a JSON array of strings")
+	}
+
+	ranges := make([]string, 0, len(list))
+	for _, r := range list {
+		str, ok := r.(string)
+		if !ok {
+			return nil, errors.New("ranges must be a JSON array of strings")
+		}
+
+		ranges = append(ranges, str)
+	}
+
+	return ranges, nil
+}
+
+// refresh reloads the set if its file has changed since it was loaded. If
+// the file can not be loaded, the previous ranges are kept.
+func (s *IPSet) refresh() {
+	if s.File == "" {
+		return
+	}
+
+	s.mu.Lock()
+	if time.Since(s.lastCheck) < ipSetCheckInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastCheck = time.Now()
+	modTime := s.modTime
+	s.mu.Unlock()
+
+	fi, err := os.Stat(s.File)
+	if err != nil {
+		log.Printf("error checking IP set file %s: %s", s.File, err)
+		return
+	}
+
+	if fi.ModTime().Equal(modTime) {
+		return
+	}
+
+	if err := s.load(); err != nil {
+		log.Printf("error reloading IP set file %s, keeping previous ranges: %s", s.File, err)
+		return
+	}
+
+	log.Printf("reloaded IP set file %s", s.File)
+}
+
+// Contains returns true if ip is in any of the set's ranges.
+func (s *IPSet) Contains(ip net.IP) bool {
+	s.refresh()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ranges != nil && s.ranges.contains(ip)
+}
+
+// ipTrie is a binary prefix tree of IP ranges, with separate trees for
+// IPv4 and IPv6 ranges.
+type ipTrie struct {
+	v4, v6 ipTrieNode
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	end      bool
+}
+
+// insert adds an IP address or a range in CIDR notation to the trie.
+func (t *ipTrie) insert(r string) error {
+	r = strings.TrimSpace(r)
+
+	var (
+		ip   net.IP
+		ones int
+	)
+
+	if strings.Contains(r, "/") {
+		addr, cidr, err := net.ParseCIDR(r)
+		if err != nil {
+			return err
+		}
+
+		var bits int
+
+		ip = cidr.IP
+		ones, bits = cidr.Mask.Size()
+
+		// IPv4-mapped ranges are stored in the IPv4 tree, so the prefix
+		// must cover the mapping.
+		if bits == 8*net.IPv6len && addr.To4() != nil {
+			if ones < 96 {
+				return fmt.Errorf("invalid IPv4-mapped range %q: prefix must be at least /96", r)
+			}
+
+			ones -= 96
+		}
+	} else {
+		ip = net.ParseIP(r)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", r)
+		}
+
+		ones = 8 * len(ipBytes(ip))
+	}
+
+	n := t.root(ip)
+	b := ipBytes(ip)
+
+	for i := 0; i < ones && !n.end; i++ {
+		bit := b[i/8] >> (7 - uint(i%8)) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = new(ipTrieNode)
+		}
+
+		n = n.children[bit]
+	}
+
+	n.end = true
+	n.children = [2]*ipTrieNode{}
+
+	return nil
+}
+
+// contains returns true if ip is in any of the trie's ranges.
+func (t *ipTrie) contains(ip net.IP) bool {
+	n := t.root(ip)
+	b := ipBytes(ip)
+
+	for i := 0; i < 8*len(b); i++ {
+		if n.end {
+			return true
+		}
+
+		n = n.children[b[i/8]>>(7-uint(i%8))&1]
+		if n == nil {
+			return false
+		}
+	}
+
+	return n.end
+}
+
+func (t *ipTrie) root(ip net.IP) *ipTrieNode {
+	if ip.To4() != nil {
+		return &t.v4
+	}
+
+	return &t.v6
+}
+
+// ipBytes returns the 4 byte form of IPv4 addresses, and the 16 byte form of
+// other addresses.
+func ipBytes(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+
+	return ip.To16()
+}
@@ -0,0 +1,401 @@
+package hook
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWT configures the validation of JSON Web Tokens by the jwt match type.
+// Tokens signed with an HS256, HS384 or HS512 algorithm are verified with
+// the rule's secrets; other tokens are verified with the public key, or with
+// the keys in the JWKS file.
+type JWT struct {
+	// Key is the public key, given as for PublicKey.
+	Key string `json:"key,omitempty"`
+	// KeyFile is the path to a file holding the public key.
+	KeyFile string `json:"key-file,omitempty"`
+	// KeySecret references the public key stored in a file or an
+	// environment variable.
+	KeySecret *SecretRef `json:"key-secret,omitempty"`
+	// JWKSFile is the path to a JSON Web Key Set file.
+	JWKSFile string `json:"jwks-file,omitempty"`
+	// Algorithms lists the accepted signature algorithms. If it is empty,
+	// all supported algorithms are accepted.
+	Algorithms []string `json:"algorithms,omitempty"`
+	// Issuer is the required iss claim.
+	Issuer string `json:"issuer,omitempty"`
+	// Audience is the required aud claim.
+	Audience string `json:"audience,omitempty"`
+	// Leeway is the allowed clock skew when checking the exp and nbf
+	// claims.
+	Leeway string `json:"leeway,omitempty"`
+	// RequireExp rejects tokens without an exp claim, which would
+	// otherwise never expire.
+	RequireExp bool `json:"require-exp,omitempty"`
+
+	keys   []jsonWebKey
+	leeway time.Duration
+}
+
+// jsonWebKey is a public key with its optional key ID.
+type jsonWebKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// jwtAlgorithms maps the supported JWT algorithms to the signature
+// algorithms used to verify them. HMAC algorithms map to the hash name.
+var jwtAlgorithms = map[string]string{
+	"HS256": "sha256",
+	"HS384": "sha384",
+	"HS512": "sha512",
+	"RS256": "rsa-sha256",
+	"RS384": "rsa-sha384",
+	"RS512": "rsa-sha512",
+	"PS256": "rsa-pss-sha256",
+	"PS384": "rsa-pss-sha384",
+	"PS512": "rsa-pss-sha512",
+	"ES256": "ecdsa-sha256",
+	"ES384": "ecdsa-sha384",
+	"ES512": "ecdsa-sha512",
+	"EdDSA": "ed25519",
+}
+
+// prepare loads the keys and validates the configuration. hasSecret is set if
+// the rule has secrets to verify HMAC signed tokens with.
+func (j *JWT) prepare(c *configChecker, path string, hasSecret bool) {
+	if !hasSecret && j.Key == "" && j.KeyFile == "" && j.KeySecret == nil && j.JWKSFile == "" {
+		c.add(path, errors.New("missing key"))
+	}
+
+	for i, alg := range j.Algorithms {
+		if _, ok := jwtAlgorithms[alg]; !ok {
+			c.add(fmt.Sprintf("%s.algorithms[%d]", path, i), fmt.Errorf("unsupported algorithm %q", alg))
+		}
+	}
+
+	if j.Leeway != "" {
+		d, err := time.ParseDuration(j.Leeway)
+		if err == nil && d < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			c.add(path+".leeway", err)
+		}
+
+		j.leeway = d
+	}
+
+	if j.Key != "" || j.KeyFile != "" || j.KeySecret != nil {
+		pk := PublicKey{Key: j.Key, KeyFile: j.KeyFile, KeySecret: j.KeySecret}
+
+		data, err := pk.keyData()
+		if err == nil {
+			var key crypto.PublicKey
+
+			key, err = parsePublicKey(data)
+			j.keys = append(j.keys, jsonWebKey{key: key})
+		}
+		if err != nil {
+			c.add(path, err)
+		}
+	}
+
+	if j.JWKSFile != "" {
+		keys, err := loadJWKS(j.JWKSFile)
+		if err != nil {
+			c.add(path+".jwks-file", err)
+		}
+
+		j.keys = append(j.keys, keys...)
+	}
+}
+
+// tokenError returns a signature error for an invalid token. The token is
+// never included in the error.
+func tokenError(reason string) error {
+	return &SignatureError{Signature: "token: " + reason}
+}
+
+// check validates the token and returns its claims. verifyHMAC verifies
+// tokens signed with HMAC algorithms; if it is nil, they are rejected.
+func (j *JWT) check(token string, now time.Time, verifyHMAC func(signed, sig []byte, hash string) (bool, error)) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, tokenError("malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	b, err := decodeBase64(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, tokenError("malformed header")
+	}
+
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok || (len(j.Algorithms) > 0 && !containsString(j.Algorithms, header.Alg)) {
+		return nil, tokenError(fmt.Sprintf("algorithm %q not allowed", header.Alg))
+	}
+
+	sig, err := decodeBase64(parts[2])
+	if err != nil {
+		return nil, tokenError("malformed signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch {
+	case strings.HasPrefix(header.Alg, "HS"):
+		if verifyHMAC == nil {
+			return nil, tokenError(fmt.Sprintf("algorithm %q not allowed", header.Alg))
+		}
+
+		ok, err = verifyHMAC(signed, sig, alg)
+
+	case len(j.keys) == 0:
+		return nil, tokenError(fmt.Sprintf("algorithm %q not allowed", header.Alg))
+
+	default:
+		ok, err = j.verify(alg, header.Kid, signed, sig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, tokenError("invalid signature")
+	}
+
+	b, err = decodeBase64(parts[1])
+	if err != nil {
+		return nil, tokenError("malformed claims")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var claims map[string]interface{}
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, tokenError("malformed claims")
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok && j.RequireExp {
+		return nil, tokenError("missing exp claim")
+	}
+	if ok && now.After(time.Unix(exp, 0).Add(j.leeway)) {
+		return nil, tokenError("expired")
+	}
+
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Before(time.Unix(nbf, 0).Add(-j.leeway)) {
+		return nil, tokenError("not yet valid")
+	}
+
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return nil, tokenError("invalid issuer")
+	}
+
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return nil, tokenError("invalid audience")
+	}
+
+	return claims, nil
+}
+
+// verify verifies the signature with the key whose ID is kid, or with any
+// of the keys if kid is empty.
+func (j *JWT) verify(alg, kid string, signed, sig []byte) (bool, error) {
+	for _, k := range j.keys {
+		if kid != "" && k.id != "" && k.id != kid {
+			continue
+		}
+
+		if checkKeyAlgorithm(k.key, alg) != nil {
+			continue
+		}
+
+		if verifySignature(alg, k.key, signed, sig) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkJWTHMAC verifies the HMAC signature sig of signed using secret.
+func checkJWTHMAC(signed, sig []byte, hash, secret string) (bool, error) {
+	if secret == "" {
+		return false, errors.New("signature validation secret can not be empty")
+	}
+
+	h := map[string]crypto.Hash{"sha256": crypto.SHA256, "sha384": crypto.SHA384, "sha512": crypto.SHA512}[hash]
+
+	mac := hmac.New(h.New, []byte(secret))
+	mac.Write(signed)
+
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return false, tokenError("invalid signature")
+	}
+
+	return true, nil
+}
+
+// numericClaim returns the value of a NumericDate claim.
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(f), true
+}
+
+// hasAudience returns true if the aud claim, either a string or an array of
+// strings, contains audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containsString returns true if s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadJWKS loads the supported public keys from a JSON Web Key Set file.
+func loadJWKS(path string) ([]jsonWebKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jsonWebKey
+
+	for i, k := range set.Keys {
+		var (
+			key crypto.PublicKey
+			err error
+		)
+
+		switch k.Kty {
+		case "RSA":
+			var n, e []byte
+
+			n, err = decodeBase64(k.N)
+			if err == nil {
+				e, err = decodeBase64(k.E)
+			}
+
+			if err == nil {
+				key = &rsa.PublicKey{
+					N: new(big.Int).SetBytes(n),
+					E: int(new(big.Int).SetBytes(e).Int64()),
+				}
+			}
+
+		case "EC":
+			var x, y []byte
+
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+
+			curve, ok := curves[k.Crv]
+			if !ok {
+				continue
+			}
+
+			x, err = decodeBase64(k.X)
+			if err == nil {
+				y, err = decodeBase64(k.Y)
+			}
+
+			if err == nil {
+				key = &ecdsa.PublicKey{
+					Curve: curve,
+					X:     new(big.Int).SetBytes(x),
+					Y:     new(big.Int).SetBytes(y),
+				}
+			}
+
+		case "OKP":
+			if k.Crv != "Ed25519" {
+				continue
+			}
+
+			var x []byte
+
+			x, err = decodeBase64(k.X)
+			if err == nil && len(x) != ed25519.PublicKeySize {
+				err = errors.New("invalid Ed25519 key size")
+			}
+
+			key = ed25519.PublicKey(x)
+
+		default:
+			// Symmetric and unknown keys are skipped.
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+
+		keys = append(keys, jsonWebKey{id: k.Kid, key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no supported keys found")
+	}
+
+	return keys, nil
+}
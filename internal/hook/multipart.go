@@ -0,0 +1,107 @@
+package hook
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Properties of an uploaded file that can be referenced by a multipart-file
+// argument, ie. "upload.filename".
+const (
+	FilePropertyPath        = "path"
+	FilePropertyFilename    = "filename"
+	FilePropertyContentType = "content-type"
+	FilePropertySize        = "size"
+)
+
+// File is a file uploaded with a multipart request. Uploaded files are saved
+// to disk while the request is parsed, and removed once the hook's command
+// has run.
+type File struct {
+	// Field is the name of the form field the file was uploaded as.
+	Field string
+
+	// Filename is the name of the file given by the client.
+	Filename string
+
+	// ContentType is the Content-Type of the part holding the file.
+	ContentType string
+
+	// Size is the size of the file in bytes.
+	Size int64
+
+	// Path is the path of the saved file.
+	Path string
+}
+
+// property returns the named property of the file.
+func (f *File) property(name string) string {
+	switch name {
+	case FilePropertyFilename:
+		return f.Filename
+	case FilePropertyContentType:
+		return f.ContentType
+	case FilePropertySize:
+		return strconv.FormatInt(f.Size, 10)
+	default:
+		return f.Path
+	}
+}
+
+// AddFile records a file uploaded with the request.
+func (r *Request) AddFile(f *File) {
+	if r.Files == nil {
+		r.Files = make(map[string][]*File)
+	}
+
+	r.Files[f.Field] = append(r.Files[f.Field], f)
+}
+
+// RemoveFiles removes the saved files uploaded with the request.
+func (r *Request) RemoveFiles() {
+	for _, files := range r.Files {
+		for _, f := range files {
+			log.Printf("[%s] removing uploaded file %s\n", r.ID, f.Path)
+
+			if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+				log.Printf("[%s] error removing uploaded file %s [%s]", r.ID, f.Path, err)
+			}
+		}
+	}
+
+	r.Files = nil
+}
+
+// lookupFile returns the uploaded file referenced by name and the property
+// referenced. The name is the form field, followed by the index of the file
+// if the field holds several files, and a property, ie. "upload.1.filename".
+// It references the path of the first file of the field by default.
+func (r *Request) lookupFile(name string) (*File, string, error) {
+	field, prop := name, FilePropertyPath
+
+	if i := strings.LastIndexByte(field, '.'); i != -1 {
+		switch p := field[i+1:]; p {
+		case FilePropertyPath, FilePropertyFilename, FilePropertyContentType, FilePropertySize:
+			field, prop = field[:i], p
+		}
+	}
+
+	index := 0
+
+	if _, ok := r.Files[field]; !ok {
+		if i := strings.LastIndexByte(field, '.'); i != -1 {
+			if n, err := strconv.Atoi(field[i+1:]); err == nil {
+				field, index = field[:i], n
+			}
+		}
+	}
+
+	files := r.Files[field]
+	if index < 0 || index >= len(files) {
+		return nil, "", &ParameterNodeError{name}
+	}
+
+	return files[index], prop, nil
+}
@@ -0,0 +1,301 @@
+package hook
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"text/template"
+)
+
+// PublicKey configures the verification of a public-key signature, such as
+// an Ed25519, RSA or ECDSA signature.
+type PublicKey struct {
+	// Key is the public key, either PEM encoded or as base64 or hex
+	// encoded DER. Ed25519 keys may also be given as the base64 or hex
+	// encoded raw 32 byte key.
+	Key string `json:"key,omitempty"`
+	// KeyFile is the path to a file holding the public key.
+	KeyFile string `json:"key-file,omitempty"`
+	// KeySecret references the public key stored in a file or an
+	// environment variable.
+	KeySecret *SecretRef `json:"key-secret,omitempty"`
+	// Algorithm is the signature algorithm. See SignatureAlgorithms.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Encoding is the encoding of the signature: base64 or hex.
+	Encoding string `json:"encoding,omitempty"`
+	// SignedMessage is a template of the signed message. It is executed
+	// with SignedStringData and defaults to the request body.
+	SignedMessage string `json:"signed-message,omitempty"`
+
+	key           crypto.PublicKey
+	signedMessage *template.Template
+}
+
+// SignatureAlgorithms lists the supported public-key signature algorithms.
+var SignatureAlgorithms = []string{
+	"ed25519",
+	"rsa-sha256", "rsa-sha384", "rsa-sha512",
+	"rsa-pss-sha256", "rsa-pss-sha384", "rsa-pss-sha512",
+	"ecdsa-sha256", "ecdsa-sha384", "ecdsa-sha512",
+}
+
+// prepare loads the public key, validates the configuration and compiles
+// the signed message template.
+func (k *PublicKey) prepare(c *configChecker, path string) {
+	setDefault(&k.Encoding, "base64")
+	setDefault(&k.SignedMessage, "{{.Body}}")
+
+	if k.Encoding != "hex" && k.Encoding != "base64" {
+		c.add(path+".encoding", fmt.Errorf("unsupported encoding %q", k.Encoding))
+	}
+
+	tmpl, err := template.New(path).Parse(k.SignedMessage)
+	if err != nil {
+		c.add(path+".signed-message", err)
+	}
+
+	k.signedMessage = tmpl
+
+	data, err := k.keyData()
+	if err != nil {
+		c.add(path, err)
+		return
+	}
+
+	k.key, err = parsePublicKey(data)
+	if err != nil {
+		c.add(path, err)
+		return
+	}
+
+	if err := checkKeyAlgorithm(k.key, k.Algorithm); err != nil {
+		c.add(path+".algorithm", err)
+	}
+}
+
+// keyData returns the configured public key.
+func (k *PublicKey) keyData() ([]byte, error) {
+	n := 0
+	for _, set := range []bool{k.Key != "", k.KeyFile != "", k.KeySecret != nil} {
+		if set {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return nil, errors.New("exactly one of key, key-file or key-secret must be set")
+	}
+
+	switch {
+	case k.KeyFile != "":
+		b, err := ioutil.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file: %w", err)
+		}
+
+		return b, nil
+
+	case k.KeySecret != nil:
+		v, err := k.KeySecret.Resolve()
+		return []byte(v), err
+	}
+
+	return []byte(k.Key), nil
+}
+
+// check verifies the public-key signature of the request.
+func (k *PublicKey) check(req *Request, signature string) (bool, error) {
+	if k.key == nil || k.signedMessage == nil {
+		return false, errors.New("public key is not configured")
+	}
+
+	var (
+		sig []byte
+		err error
+	)
+
+	if k.Encoding == "hex" {
+		sig, err = hex.DecodeString(signature)
+	} else {
+		sig, err = decodeBase64(signature)
+	}
+
+	if err != nil {
+		return false, &SignatureError{Signature: signature}
+	}
+
+	var msg bytes.Buffer
+
+	err = k.signedMessage.Execute(&msg, &SignedStringData{
+		Body:    string(req.Body),
+		Headers: req.Headers,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := verifySignature(k.Algorithm, k.key, msg.Bytes(), sig); err != nil {
+		return false, &SignatureError{Signature: signature}
+	}
+
+	return true, nil
+}
+
+// parsePublicKey parses a PEM encoded public key or certificate, or a
+// base64 or hex encoded DER public key or raw Ed25519 key.
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		switch block.Type {
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			return cert.PublicKey, nil
+		}
+
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+
+	s := strings.TrimSpace(string(data))
+
+	der, err := hex.DecodeString(s)
+	if err != nil {
+		der, err = decodeBase64(s)
+		if err != nil {
+			return nil, errors.New("public key is neither PEM, base64 nor hex encoded")
+		}
+	}
+
+	if len(der) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(der), nil
+	}
+
+	return x509.ParsePKIXPublicKey(der)
+}
+
+// checkKeyAlgorithm returns an error if the signature algorithm alg is not
+// supported or can not be used with key.
+func checkKeyAlgorithm(key crypto.PublicKey, alg string) error {
+	var ok bool
+
+	switch {
+	case alg == "ed25519":
+		_, ok = key.(ed25519.PublicKey)
+	case strings.HasPrefix(alg, "rsa-"):
+		_, ok = key.(*rsa.PublicKey)
+	case strings.HasPrefix(alg, "ecdsa-"):
+		_, ok = key.(*ecdsa.PublicKey)
+	default:
+		return fmt.Errorf("unsupported algorithm %q, must be one of %s", alg, strings.Join(SignatureAlgorithms, ", "))
+	}
+
+	if _, err := signatureHash(alg); err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("algorithm %q can not be used with a %T key", alg, key)
+	}
+
+	return nil
+}
+
+// signatureHash returns the hash used by the signature algorithm alg.
+func signatureHash(alg string) (crypto.Hash, error) {
+	switch {
+	case alg == "ed25519":
+		return 0, nil
+	case strings.HasSuffix(alg, "-sha256"):
+		return crypto.SHA256, nil
+	case strings.HasSuffix(alg, "-sha384"):
+		return crypto.SHA384, nil
+	case strings.HasSuffix(alg, "-sha512"):
+		return crypto.SHA512, nil
+	}
+
+	return 0, fmt.Errorf("unsupported algorithm %q, must be one of %s", alg, strings.Join(SignatureAlgorithms, ", "))
+}
+
+// verifySignature verifies the signature sig of msg with the public key
+// using the signature algorithm alg. ECDSA signatures may be either ASN.1
+// DER encoded or the concatenation of the fixed size r and s values.
+func verifySignature(alg string, key crypto.PublicKey, msg, sig []byte) error {
+	if err := checkKeyAlgorithm(key, alg); err != nil {
+		return err
+	}
+
+	if alg == "ed25519" {
+		if !ed25519.Verify(key.(ed25519.PublicKey), msg, sig) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	}
+
+	h, err := signatureHash(alg)
+	if err != nil {
+		return err
+	}
+
+	hasher := h.New()
+	hasher.Write(msg)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "rsa-pss-") {
+			return rsa.VerifyPSS(k, h, digest, sig, nil)
+		}
+
+		return rsa.VerifyPKCS1v15(k, h, digest, sig)
+
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) == 2*size {
+			rs.R = new(big.Int).SetBytes(sig[:size])
+			rs.S = new(big.Int).SetBytes(sig[size:])
+		} else if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) != 0 {
+			return errors.New("invalid signature encoding")
+		}
+
+		if !ecdsa.Verify(k, digest, rs.R, rs.S) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// decodeBase64 decodes s in any of the standard or URL-safe base64
+// encodings, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+
+	return nil, errors.New("invalid base64 encoding")
+}
@@ -0,0 +1,150 @@
+package hook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/adnanh/webhook/internal/ratelimit"
+)
+
+// Keys of a rate limit.
+const (
+	RateLimitKeyHook     = "hook"
+	RateLimitKeyClientIP = "client-ip"
+	RateLimitKeyArgument = "argument"
+)
+
+// RateLimit limits the rate of requests to a hook.
+type RateLimit struct {
+	// Requests is the number of requests allowed per Interval.
+	Requests int `json:"requests"`
+	// Interval is the duration, such as "1m", over which Requests are
+	// allowed. It defaults to one second.
+	Interval string `json:"interval,omitempty"`
+	// Burst is the number of requests allowed at once. It defaults to
+	// Requests.
+	Burst int `json:"burst,omitempty"`
+	// Key is what requests are limited by: the hook as a whole (the
+	// default), the client IP address, or the value of Parameter.
+	Key string `json:"key,omitempty"`
+	// Parameter is the request value requests are limited by if Key is
+	// "argument". Only header, url and request values can be used, since
+	// the limit is enforced before the request body is read.
+	Parameter *Argument `json:"parameter,omitempty"`
+
+	limiter *ratelimit.Limiter
+}
+
+// prepare creates the rate limiter, reporting problems at path.
+func (l *RateLimit) prepare(c *configChecker, path string) {
+	if l.Requests <= 0 {
+		c.add(path+".requests", errors.New("must be positive"))
+		return
+	}
+
+	interval := time.Second
+	if l.Interval != "" {
+		d, err := time.ParseDuration(l.Interval)
+		if err == nil && d <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			c.add(path+".interval", err)
+			return
+		}
+
+		interval = d
+	}
+
+	if l.Burst < 0 {
+		c.add(path+".burst", errors.New("must not be negative"))
+	}
+
+	switch l.Key {
+	case "", RateLimitKeyHook, RateLimitKeyClientIP:
+	case RateLimitKeyArgument:
+		if l.Parameter == nil {
+			c.add(path+".parameter", errors.New("missing parameter"))
+			break
+		}
+
+		switch l.Parameter.Source {
+		case SourceHeader, SourceQuery, SourceQueryAlias, SourceRequest:
+			l.Parameter.prepare(c, path+".parameter")
+		default:
+			c.add(path+".parameter", fmt.Errorf("unsupported source %q; use header, url or request", l.Parameter.Source))
+		}
+	default:
+		c.add(path+".key", fmt.Errorf("unsupported key %q", l.Key))
+	}
+
+	l.limiter = ratelimit.New(l.Requests, interval, l.Burst)
+}
+
+// Inherit takes over the limiter of old, the rate limit of the hook before
+// the hooks were reloaded, if the settings are unchanged, so that reloading
+// the hooks does not reset the limit.
+func (l *RateLimit) Inherit(old *RateLimit) {
+	if old == nil || old.limiter == nil || l.limiter == nil {
+		return
+	}
+
+	if l.Requests != old.Requests || l.Interval != old.Interval || l.Burst != old.Burst || l.Key != old.Key {
+		return
+	}
+
+	if (l.Parameter == nil) != (old.Parameter == nil) {
+		return
+	}
+
+	if p, op := l.Parameter, old.Parameter; p != nil && (p.Source != op.Source || p.Name != op.Name || p.Expression != op.Expression || p.Base64Decode != op.Base64Decode) {
+		return
+	}
+
+	l.limiter = old.limiter
+}
+
+// Allow returns true if the request is within the rate limit. Otherwise, it
+// returns the time until the next request is allowed.
+func (l *RateLimit) Allow(req *Request) (bool, time.Duration) {
+	if l.limiter == nil {
+		return true, 0
+	}
+
+	return l.limiter.Allow(l.key(req))
+}
+
+// key returns the key the request is limited by.
+func (l *RateLimit) key(req *Request) string {
+	switch l.Key {
+	case RateLimitKeyClientIP:
+		addr := req.ClientAddr()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			return host
+		}
+
+		return addr
+
+	case RateLimitKeyArgument:
+		if l.Parameter == nil {
+			return ""
+		}
+
+		// The headers and query are parsed along with the body, after
+		// the rate limit is enforced.
+		if req.Headers == nil && req.RawRequest != nil {
+			r := &Request{RawRequest: req.RawRequest, RemoteAddr: req.RemoteAddr}
+			r.ParseHeaders(req.RawRequest.Header)
+			r.ParseQuery(req.RawRequest.URL.Query())
+			req = r
+		}
+
+		v, _ := l.Parameter.Get(req)
+
+		return v
+	}
+
+	return ""
+}
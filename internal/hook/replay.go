@@ -0,0 +1,82 @@
+package hook
+
+import (
+	"sync"
+	"time"
+)
+
+// maxDeliveries is the maximum number of delivery IDs remembered by
+// deliveries. Once it is reached, the oldest IDs are forgotten first.
+const maxDeliveries = 10000
+
+// deliveries remembers the delivery IDs of recently verified requests, keyed
+// by the hook ID and the delivery ID.
+var deliveries = newDeliveryCache(maxDeliveries)
+
+// deliveryCache is a bounded cache of delivery IDs used to detect replayed
+// requests.
+type deliveryCache struct {
+	mu    sync.Mutex
+	max   int
+	seen  map[string]time.Time
+	order []delivery
+}
+
+type delivery struct {
+	id   string
+	seen time.Time
+}
+
+func newDeliveryCache(max int) *deliveryCache {
+	return &deliveryCache{
+		max:  max,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Replayed records the delivery id as seen at now and returns true if it
+// was already seen within window.
+func (c *deliveryCache) Replayed(id string, window time.Duration, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.seen[id]; ok && now.Sub(t) < window {
+		return true
+	}
+
+	for len(c.order) >= c.max {
+		d := c.order[0]
+		c.order = c.order[1:]
+
+		// The ID may have been seen again since this entry was added.
+		if c.seen[d.id].Equal(d.seen) {
+			delete(c.seen, d.id)
+		}
+	}
+
+	c.seen[id] = now
+	c.order = append(c.order, delivery{id, now})
+
+	return false
+}
+
+// Forget removes the delivery id, so that it is no longer reported as
+// replayed.
+func (c *deliveryCache) Forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The entry in order is skipped when it is evicted.
+	delete(c.seen, id)
+}
+
+// ForgetDeliveries removes the delivery IDs recorded while evaluating the
+// request's rules from the replay cache, so that the delivery can be retried
+// when the hook was not triggered or failed.
+func (r *Request) ForgetDeliveries() {
+	for _, key := range r.deliveries {
+		deliveries.Forget(key)
+	}
+
+	r.deliveries = nil
+}
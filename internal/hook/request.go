@@ -8,6 +8,8 @@ import (
 	"net/url"
 	"unicode"
 
+	"github.com/adnanh/webhook/internal/redact"
+
 	"github.com/clbanning/mxj"
 )
 
@@ -16,12 +18,20 @@ type Request struct {
 	// The request ID set by the RequestID middleware.
 	ID string
 
+	// HookID is the ID of the hook the request is for.
+	HookID string
+
 	// The Content-Type of the request.
 	ContentType string
 
-	// The raw request body.
+	// The raw request body. If the body was compressed, it holds the
+	// decoded body.
 	Body []byte
 
+	// RawBody is the request body as received, before it was decoded by
+	// DecodeBody. It is nil if the body was not decoded.
+	RawBody []byte
+
 	// Headers is a map of the parsed headers.
 	Headers map[string]interface{}
 
@@ -31,11 +41,56 @@ type Request struct {
 	// Payload is a map of the parsed payload.
 	Payload map[string]interface{}
 
+	// Claims is a map of the claims of the JSON Web Token verified by a
+	// jwt rule.
+	Claims map[string]interface{}
+
+	// Files maps the form fields of a multipart request to the files
+	// uploaded in them.
+	Files map[string][]*File
+
 	// The underlying HTTP request.
 	RawRequest *http.Request
 
+	// RemoteAddr is the address of the client that sent the request. It
+	// differs from the remote address of RawRequest when the request was
+	// forwarded by a trusted proxy.
+	RemoteAddr string
+
 	// Treat signature errors as simple validate failures.
 	AllowSignatureErrors bool
+
+	// deliveries holds the keys of the delivery IDs recorded in the replay
+	// cache while evaluating the request's rules.
+	deliveries []string
+
+	// TimeWindowMismatch describes why a time-window rule did not match,
+	// such as "blackout period: holiday freeze".
+	TimeWindowMismatch string
+
+	// trace is the node under which the evaluation of rules is recorded
+	// by Rules.Trace.
+	trace *RuleTrace
+}
+
+// ClientAddr returns the address of the client that sent the request.
+func (r *Request) ClientAddr() string {
+	if r.RemoteAddr != "" || r.RawRequest == nil {
+		return r.RemoteAddr
+	}
+
+	return r.RawRequest.RemoteAddr
+}
+
+// Redacted returns a copy of the request that is safe to log, with the values
+// of redacted headers and payload paths masked.
+func (r *Request) Redacted() *Request {
+	c := *r
+	c.Headers = redact.HeaderMap(r.Headers)
+	c.Payload = redact.Payload(r.Payload)
+	c.Body = redact.Body(r.Body, r.ContentType)
+
+	return &c
 }
 
 // ParseJSONPayload parse the json payload of request
@@ -73,24 +128,12 @@ func (r *Request) ParseJSONPayload() error {
 
 // ParseHeaders parse the request headers
 func (r *Request) ParseHeaders(headers map[string][]string) {
-	r.Headers = make(map[string]interface{}, len(headers))
-
-	for k, v := range headers {
-		if len(v) > 0 {
-			r.Headers[k] = v[0]
-		}
-	}
+	r.Headers = ValuesToMap(headers)
 }
 
 // ParseQuery parse request query
 func (r *Request) ParseQuery(query map[string][]string) {
-	r.Query = make(map[string]interface{}, len(query))
-
-	for k, v := range query {
-		if len(v) > 0 {
-			r.Query[k] = v[0]
-		}
-	}
+	r.Query = ValuesToMap(query)
 }
 
 // ParseFormPayload parse the request
@@ -100,15 +143,48 @@ func (r *Request) ParseFormPayload() error {
 		return fmt.Errorf("error parsing form payload %+v", err)
 	}
 
-	r.Payload = make(map[string]interface{}, len(fd))
+	r.Payload = ValuesToMap(fd)
 
-	for k, v := range fd {
-		if len(v) > 0 {
-			r.Payload[k] = v[0]
+	return nil
+}
+
+// RepeatedValues holds all the values of a header, query parameter or form
+// field given more than once. A reference to the name resolves to the first
+// value, as for a single value; the other values are referenced by index, ie.
+// "tag.1", and are included by the entire-* sources.
+type RepeatedValues []interface{}
+
+// firstValue returns the first value of RepeatedValues, or v itself.
+func firstValue(v interface{}) interface{} {
+	if rv, ok := v.(RepeatedValues); ok && len(rv) > 0 {
+		return rv[0]
+	}
+
+	return v
+}
+
+// ValuesToMap converts headers, query or form values to a map. A name with a
+// single value maps to the value, and a repeated name maps to the
+// RepeatedValues of all its values.
+func ValuesToMap(values map[string][]string) map[string]interface{} {
+	m := make(map[string]interface{}, len(values))
+
+	for k, v := range values {
+		switch len(v) {
+		case 0:
+		case 1:
+			m[k] = v[0]
+		default:
+			l := make(RepeatedValues, len(v))
+			for i := range v {
+				l[i] = v[i]
+			}
+
+			m[k] = l
 		}
 	}
 
-	return nil
+	return m
 }
 
 // ParseXMLPayload parse xml payload
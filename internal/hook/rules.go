@@ -0,0 +1,84 @@
+package hook
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// prepareRules readies the named rules of a hooks file and checks that their
+// references do not form a cycle.
+func (s *shared) prepareRules(c *configChecker) {
+	names := make([]string, 0, len(s.rules))
+	for name := range s.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if s.rules[name] == nil {
+			c.add("rules."+name, errors.New("empty rule"))
+			continue
+		}
+
+		s.rules[name].prepare(c, "rules."+name)
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	state := make(map[string]int, len(names))
+
+	var visit func(name string, stack []string)
+	visit = func(name string, stack []string) {
+		switch state[name] {
+		case visited:
+			return
+		case visiting:
+			for i := range stack {
+				if stack[i] == name {
+					cycle := append(stack[i:len(stack):len(stack)], name)
+					c.add("rules."+name, fmt.Errorf("reference cycle %s", strings.Join(cycle, " -> ")))
+					return
+				}
+			}
+		}
+
+		r := s.rules[name]
+		if r == nil {
+			return
+		}
+
+		state[name] = visiting
+		r.refs(func(ref string) {
+			visit(ref, append(stack, name))
+		})
+		state[name] = visited
+	}
+
+	for _, name := range names {
+		visit(name, nil)
+	}
+}
+
+// refs calls fn with the name of each rule referenced by the rule tree.
+func (r *Rules) refs(fn func(name string)) {
+	switch {
+	case r.And != nil:
+		for i := range *r.And {
+			(*r.And)[i].refs(fn)
+		}
+	case r.Or != nil:
+		for i := range *r.Or {
+			(*r.Or)[i].refs(fn)
+		}
+	case r.Not != nil:
+		(*Rules)(r.Not).refs(fn)
+	case r.Match != nil, r.Expression != nil:
+	case r.Ref != "":
+		fn(r.Ref)
+	}
+}
@@ -0,0 +1,137 @@
+package hook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// SecretRef references a secret that is kept outside of the hooks file,
+// either in a file, such as a Docker or Kubernetes secret mount, or in an
+// environment variable.
+type SecretRef struct {
+	File string `json:"file,omitempty"`
+	Env  string `json:"env,omitempty"`
+}
+
+// Resolve returns the value of the referenced secret. Trailing newlines are
+// removed from secrets read from files. The returned error never contains
+// the secret value.
+func (s *SecretRef) Resolve() (string, error) {
+	var v string
+
+	switch {
+	case s.File != "" && s.Env != "":
+		return "", errors.New("secret reference must set only one of file or env")
+
+	case s.File != "":
+		b, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %w", err)
+		}
+
+		v = strings.TrimRight(string(b), "\r\n")
+
+	case s.Env != "":
+		var ok bool
+
+		v, ok = os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", s.Env)
+		}
+
+	default:
+		return "", errors.New("secret reference must set file or env")
+	}
+
+	if v == "" {
+		return "", errors.New("secret is empty")
+	}
+
+	return v, nil
+}
+
+// RuleSecret is one of the secrets accepted by a signature rule. Listing
+// several secrets allows a secret to be rotated without downtime: the new
+// secret is added to the list, and the old one is removed, or expires, once
+// all senders have switched to the new one.
+type RuleSecret struct {
+	Value string `json:"value,omitempty"`
+	SecretRef
+	NotAfter string `json:"not-after,omitempty"`
+
+	notAfter time.Time
+}
+
+// UnmarshalJSON unmarshals a RuleSecret, accepting either a literal secret
+// string or an object.
+func (s *RuleSecret) UnmarshalJSON(b []byte) error {
+	switch {
+	case len(b) == 0 || string(b) == "null":
+		return nil
+
+	case b[0] == '{':
+		// Unmarshal with the YAML unmarshaller so that scalar values are
+		// converted to strings as they are for the rest of the hooks file.
+		type ruleSecret RuleSecret
+		return yaml.Unmarshal(b, (*ruleSecret)(s))
+
+	case b[0] == '"':
+		return json.Unmarshal(b, &s.Value)
+
+	default:
+		s.Value = string(b)
+		return nil
+	}
+}
+
+// prepare resolves the secret's reference and parses its expiry time.
+func (s *RuleSecret) prepare(c *configChecker, path string) {
+	if s.File != "" || s.Env != "" {
+		if s.Value != "" {
+			c.add(path, errors.New("secret must set only one of value, file or env"))
+		} else {
+			v, err := s.SecretRef.Resolve()
+			if err != nil {
+				c.add(path, err)
+			}
+
+			s.Value = v
+		}
+	}
+
+	if s.NotAfter != "" {
+		t, err := parseNotAfter(s.NotAfter)
+		if err != nil {
+			c.add(path+".not-after", err)
+		}
+
+		s.notAfter = t
+	}
+}
+
+// Expired returns true if the secret has an expiry time and now is after it.
+func (s *RuleSecret) Expired(now time.Time) bool {
+	return !s.notAfter.IsZero() && now.After(s.notAfter)
+}
+
+// parseNotAfter parses an expiry time given either in RFC 3339 format or as
+// a date. A date expires at the end of that day in UTC.
+func parseNotAfter(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: must be an RFC 3339 time or a YYYY-MM-DD date", v)
+	}
+
+	return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
@@ -0,0 +1,239 @@
+package hook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/adnanh/webhook/internal/redact"
+)
+
+// DefaultSignatureTolerance is the default maximum age of a timestamped
+// signature.
+const DefaultSignatureTolerance = 5 * time.Minute
+
+// TimestampedHMAC configures the verification of an HMAC signature over a
+// string that includes a timestamp, such as the signatures sent by Stripe
+// and Slack. Signing the timestamp lets old requests be rejected.
+type TimestampedHMAC struct {
+	// SignatureHeader is the name of the header holding the signature.
+	SignatureHeader string `json:"signature-header,omitempty"`
+	// SignatureKey is the key of the signature within a header of
+	// comma-separated key=value pairs. If it is empty, the whole header
+	// value is the signature.
+	SignatureKey string `json:"signature-key,omitempty"`
+	// SignaturePrefix is removed from the signature.
+	SignaturePrefix string `json:"signature-prefix,omitempty"`
+	// TimestampHeader is the name of the header holding the timestamp in
+	// seconds since the Unix epoch.
+	TimestampHeader string `json:"timestamp-header,omitempty"`
+	// TimestampKey is the key of the timestamp within a header of
+	// comma-separated key=value pairs.
+	TimestampKey string `json:"timestamp-key,omitempty"`
+	// SignedString is a template of the signed string. It is executed with
+	// SignedStringData.
+	SignedString string `json:"signed-string,omitempty"`
+	// Algorithm is the HMAC hash algorithm: sha1, sha256 or sha512.
+	Algorithm string `json:"algorithm,omitempty"`
+	// Encoding is the encoding of the signature: hex or base64.
+	Encoding string `json:"encoding,omitempty"`
+
+	signedString *template.Template
+}
+
+// SignedStringData is the data the signed string template of a
+// TimestampedHMAC is executed with.
+type SignedStringData struct {
+	Timestamp string
+	Body      string
+	Headers   map[string]interface{}
+}
+
+// Presets of timestamped signature match types.
+var timestampedHMACPresets = map[string]TimestampedHMAC{
+	StripeSignature: {
+		SignatureHeader: "Stripe-Signature",
+		SignatureKey:    "v1",
+		TimestampHeader: "Stripe-Signature",
+		TimestampKey:    "t",
+		SignedString:    "{{.Timestamp}}.{{.Body}}",
+	},
+	SlackSignature: {
+		SignatureHeader: "X-Slack-Signature",
+		SignaturePrefix: "v0=",
+		TimestampHeader: "X-Slack-Request-Timestamp",
+		SignedString:    "v0:{{.Timestamp}}:{{.Body}}",
+	},
+}
+
+// prepare fills in the defaults for the rule type t, validates the
+// configuration and compiles the signed string template.
+func (s *TimestampedHMAC) prepare(c *configChecker, path, t string) {
+	preset := timestampedHMACPresets[t]
+
+	setDefault(&s.SignatureHeader, preset.SignatureHeader)
+	setDefault(&s.SignatureKey, preset.SignatureKey)
+	setDefault(&s.SignaturePrefix, preset.SignaturePrefix)
+	setDefault(&s.TimestampHeader, preset.TimestampHeader)
+	setDefault(&s.TimestampKey, preset.TimestampKey)
+	setDefault(&s.SignedString, preset.SignedString)
+	setDefault(&s.Algorithm, "sha256")
+	setDefault(&s.Encoding, "hex")
+
+	s.SignatureHeader = textproto.CanonicalMIMEHeaderKey(s.SignatureHeader)
+	s.TimestampHeader = textproto.CanonicalMIMEHeaderKey(s.TimestampHeader)
+
+	if s.SignatureHeader == "" {
+		c.add(path+".signature-header", errors.New("missing signature header"))
+	} else {
+		redact.AddHeaders(s.SignatureHeader)
+	}
+
+	if s.TimestampHeader == "" {
+		c.add(path+".timestamp-header", errors.New("missing timestamp header"))
+	}
+
+	if s.SignedString == "" {
+		c.add(path+".signed-string", errors.New("missing signed string"))
+	}
+
+	if newHMACHash(s.Algorithm) == nil {
+		c.add(path+".algorithm", fmt.Errorf("unsupported algorithm %q", s.Algorithm))
+	}
+
+	if s.Encoding != "hex" && s.Encoding != "base64" {
+		c.add(path+".encoding", fmt.Errorf("unsupported encoding %q", s.Encoding))
+	}
+
+	tmpl, err := template.New(path).Parse(s.SignedString)
+	if err != nil {
+		c.add(path+".signed-string", err)
+	}
+
+	s.signedString = tmpl
+}
+
+// check verifies the timestamped signature of the request using secret. A
+// signature older, or newer, than tolerance is rejected.
+func (s *TimestampedHMAC) check(req *Request, secret string, tolerance time.Duration) (bool, error) {
+	if secret == "" {
+		return false, errors.New("signature validation secret can not be empty")
+	}
+
+	if s.signedString == nil {
+		return false, errors.New("timestamped signature is not configured")
+	}
+
+	signatures := headerParams(req, s.SignatureHeader, s.SignatureKey)
+	timestamps := headerParams(req, s.TimestampHeader, s.TimestampKey)
+
+	if len(signatures) == 0 || len(timestamps) == 0 {
+		return false, &SignatureError{Signature: "missing"}
+	}
+
+	var buf bytes.Buffer
+
+	err := s.signedString.Execute(&buf, &SignedStringData{
+		Timestamp: timestamps[0],
+		Body:      string(req.Body),
+		Headers:   req.Headers,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	mac := hmac.New(newHMACHash(s.Algorithm), []byte(secret))
+	mac.Write(buf.Bytes())
+	sum := mac.Sum(nil)
+
+	var expected string
+	if s.Encoding == "base64" {
+		expected = base64.StdEncoding.EncodeToString(sum)
+	} else {
+		expected = hex.EncodeToString(sum)
+	}
+
+	valid := false
+	for i := range signatures {
+		signatures[i] = strings.TrimPrefix(signatures[i], s.SignaturePrefix)
+		if hmac.Equal([]byte(signatures[i]), []byte(expected)) {
+			valid = true
+		}
+	}
+
+	if !valid {
+		return false, &SignatureError{Signatures: signatures}
+	}
+
+	ts, err := strconv.ParseInt(timestamps[0], 10, 64)
+	if err != nil {
+		return false, &SignatureError{Signature: "invalid timestamp"}
+	}
+
+	delta := math.Abs(time.Since(time.Unix(ts, 0)).Seconds())
+	if delta > tolerance.Seconds() {
+		return false, &SignatureError{Signature: "outdated"}
+	}
+
+	return true, nil
+}
+
+// headerParams returns the values of the named request header. If key is
+// not empty, the header is parsed as comma-separated key=value pairs and the
+// values of key are returned.
+func headerParams(req *Request, name, key string) []string {
+	v, ok := headerValue(req, name)
+	if !ok || v == "" {
+		return nil
+	}
+
+	if key == "" {
+		return []string{v}
+	}
+
+	var res []string
+
+	for _, p := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			res = append(res, kv[1])
+		}
+	}
+
+	return res
+}
+
+// newHMACHash returns the hash constructor for the named algorithm, or nil
+// if the algorithm is not supported.
+func newHMACHash(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	}
+
+	return nil
+}
+
+// setDefault sets s to def if s is empty.
+func setDefault(s *string, def string) {
+	if *s == "" {
+		*s = def
+	}
+}
@@ -0,0 +1,283 @@
+package hook
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeNow returns the current time. It is replaced in tests.
+var timeNow = time.Now
+
+// TimeWindow configures the time-window match type, which matches requests
+// received on the given days and times, outside of blackout periods.
+type TimeWindow struct {
+	// Days lists the days of the week, such as "mon" or "monday", and
+	// ranges of days, such as "mon-fri". All days match if it is empty.
+	Days []string `json:"days,omitempty"`
+	// Times lists ranges of times of day, such as "09:00-17:30". The end of
+	// a range is exclusive, and a range ending before it starts, such as
+	// "22:00-02:00", spans midnight. All times match if it is empty.
+	Times []string `json:"times,omitempty"`
+	// Timezone is the IANA name of the time zone of Days, Times and
+	// Blackouts, such as "Europe/Berlin". It defaults to the local time
+	// zone.
+	Timezone string `json:"timezone,omitempty"`
+	// Blackouts lists periods during which the window is closed, such as
+	// change freezes.
+	Blackouts []Blackout `json:"blackouts,omitempty"`
+
+	days     [7]bool
+	times    []timeRange
+	location *time.Location
+}
+
+// Blackout is a period during which a time window is closed.
+type Blackout struct {
+	// From and To are dates, such as "2024-12-20", or RFC 3339 times. Both
+	// are inclusive; a date includes the whole day. To defaults to From.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Reason describes the blackout, such as "holiday freeze". It is
+	// included in the response when the hook does not trigger.
+	Reason string `json:"reason,omitempty"`
+
+	from, to time.Time
+}
+
+// timeRange is a range of minutes of the day.
+type timeRange struct {
+	start, end int
+}
+
+// weekdays maps the names of the days of the week.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// prepare parses the time window, reporting problems at path.
+func (w *TimeWindow) prepare(c *configChecker, path string) {
+	w.location = time.Local
+	if w.Timezone != "" {
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			c.add(path+".timezone", err)
+		} else {
+			w.location = loc
+		}
+	}
+
+	w.days = [7]bool{}
+	for i, d := range w.Days {
+		if err := w.parseDays(d); err != nil {
+			c.add(fmt.Sprintf("%s.days[%d]", path, i), err)
+		}
+	}
+
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	w.times = nil
+	for i, t := range w.Times {
+		r, err := parseTimeRange(t)
+		if err != nil {
+			c.add(fmt.Sprintf("%s.times[%d]", path, i), err)
+			continue
+		}
+
+		w.times = append(w.times, r)
+	}
+
+	for i := range w.Blackouts {
+		w.Blackouts[i].prepare(c, fmt.Sprintf("%s.blackouts[%d]", path, i), w.location)
+	}
+}
+
+// parseDays adds the day, or range of days, s to the window.
+func (w *TimeWindow) parseDays(s string) error {
+	p := strings.SplitN(strings.ToLower(strings.TrimSpace(s)), "-", 2)
+
+	first, ok := weekdays[strings.TrimSpace(p[0])]
+	if !ok {
+		return fmt.Errorf("invalid day %q", s)
+	}
+
+	last := first
+	if len(p) == 2 {
+		if last, ok = weekdays[strings.TrimSpace(p[1])]; !ok {
+			return fmt.Errorf("invalid day %q", s)
+		}
+	}
+
+	for d := first; ; d = (d + 1) % 7 {
+		w.days[d] = true
+
+		if d == last {
+			return nil
+		}
+	}
+}
+
+// parseTimeRange parses a range of times of day, such as "09:00-17:30".
+func parseTimeRange(s string) (timeRange, error) {
+	p := strings.SplitN(s, "-", 2)
+	if len(p) != 2 {
+		return timeRange{}, fmt.Errorf("invalid time range %q", s)
+	}
+
+	var r timeRange
+
+	for i, v := range []*int{&r.start, &r.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(p[i]))
+		if err != nil && strings.TrimSpace(p[i]) == "24:00" && i == 1 {
+			*v = 24 * 60
+			continue
+		}
+
+		if err != nil {
+			return timeRange{}, fmt.Errorf("invalid time range %q", s)
+		}
+
+		*v = t.Hour()*60 + t.Minute()
+	}
+
+	if r.start == r.end {
+		return timeRange{}, fmt.Errorf("empty time range %q", s)
+	}
+
+	return r, nil
+}
+
+// contains returns true if the minute of the day m is within the range.
+func (r timeRange) contains(m int) bool {
+	if r.start < r.end {
+		return m >= r.start && m < r.end
+	}
+
+	// The range spans midnight.
+	return m >= r.start || m < r.end
+}
+
+// prepare parses the blackout period in the location loc.
+func (b *Blackout) prepare(c *configChecker, path string, loc *time.Location) {
+	var err error
+
+	if b.from, err = parseBlackoutTime(b.From, loc, false); err != nil {
+		c.add(path+".from", err)
+	}
+
+	to := b.To
+	if to == "" {
+		to = b.From
+	}
+
+	if b.to, err = parseBlackoutTime(to, loc, true); err != nil {
+		c.add(path+".to", err)
+	}
+
+	if !b.from.IsZero() && !b.to.IsZero() && b.to.Before(b.from) {
+		c.add(path, errors.New("to is before from"))
+	}
+}
+
+// parseBlackoutTime parses an RFC 3339 time or a date. A date is the start of
+// the day, or the end of the day if end is set.
+func parseBlackoutTime(s string, loc *time.Location, end bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("missing date")
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+
+	return t, nil
+}
+
+// check returns true if the window is open at now. Otherwise, it returns a
+// description of why the window is closed.
+func (w *TimeWindow) check(now time.Time) (bool, string) {
+	loc := w.location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	now = now.In(loc)
+
+	for _, b := range w.Blackouts {
+		if !now.Before(b.from) && !now.After(b.to) {
+			if b.Reason != "" {
+				return false, "blackout period: " + b.Reason
+			}
+
+			return false, "blackout period"
+		}
+	}
+
+	day := now.Weekday()
+
+	if len(w.times) == 0 {
+		if w.days[day] {
+			return true, ""
+		}
+
+		return false, "outside of the time window"
+	}
+
+	m := now.Hour()*60 + now.Minute()
+
+	for _, r := range w.times {
+		if !r.contains(m) {
+			continue
+		}
+
+		// The part of a range spanning midnight after midnight belongs to
+		// the day the range started on.
+		if r.start > r.end && m < r.end {
+			if w.days[(day+6)%7] {
+				return true, ""
+			}
+
+			continue
+		}
+
+		if w.days[day] {
+			return true, ""
+		}
+	}
+
+	return false, "outside of the time window"
+}
+
+// checkTimeWindow returns true if the request is received while the rule's
+// time window is open. Otherwise, it records why the window is closed in the
+// request.
+func (r MatchRule) checkTimeWindow(req *Request) (bool, error) {
+	if r.TimeWindow == nil {
+		return false, errors.New("time window is not configured")
+	}
+
+	ok, reason := r.TimeWindow.check(timeNow())
+	if !ok {
+		req.TimeWindowMismatch = reason
+	}
+
+	return ok, nil
+}
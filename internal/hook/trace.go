@@ -0,0 +1,187 @@
+package hook
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/adnanh/webhook/internal/redact"
+)
+
+// RuleTrace records the evaluation of a node of a rule tree, to find out why
+// a hook did or did not trigger.
+type RuleTrace struct {
+	// Rule is the kind of the node: and, or, not, match, expression or ref.
+	Rule string `json:"rule"`
+	// Type is the type of a match rule.
+	Type string `json:"type,omitempty"`
+	// Parameter describes the request value a match rule is evaluated
+	// against, such as "payload ref".
+	Parameter string `json:"parameter,omitempty"`
+	// Value is the resolved value of the parameter. Sensitive values and
+	// the values checked against secrets are masked.
+	Value string `json:"value,omitempty"`
+	// Expression is the source of an expression rule.
+	Expression string `json:"expression,omitempty"`
+	// Ref is the name of the rule referenced by a ref rule.
+	Ref string `json:"ref,omitempty"`
+	// Result is the boolean the node evaluated to.
+	Result bool `json:"result"`
+	// Error is the error the node failed with, if any.
+	Error string `json:"error,omitempty"`
+	// Children lists the traces of the sub rules of and, or, not and ref
+	// rules.
+	Children []*RuleTrace `json:"children,omitempty"`
+}
+
+// Trace evaluates the rules like Evaluate and returns the trace of the
+// evaluation along with the result.
+func (r Rules) Trace(req *Request) (bool, *RuleTrace, error) {
+	root := &RuleTrace{}
+
+	prev := req.trace
+	req.trace = root
+	ok, err := r.Evaluate(req)
+	req.trace = prev
+
+	if len(root.Children) == 0 {
+		return ok, nil, err
+	}
+
+	return ok, root.Children[0], err
+}
+
+// evaluateTraced evaluates the rules, recording a trace node under the
+// request's current trace node.
+func (r Rules) evaluateTraced(req *Request) (bool, error) {
+	parent := req.trace
+	t := r.traceNode(req)
+	parent.Children = append(parent.Children, t)
+
+	req.trace = t
+	ok, err := r.evaluate(req)
+	req.trace = parent
+
+	t.Result = ok
+	if err != nil {
+		t.Error = err.Error()
+	}
+
+	return ok, err
+}
+
+// traceNode returns the trace node describing the rule.
+func (r Rules) traceNode(req *Request) *RuleTrace {
+	switch {
+	case r.And != nil:
+		return &RuleTrace{Rule: "and"}
+	case r.Or != nil:
+		return &RuleTrace{Rule: "or"}
+	case r.Not != nil:
+		return &RuleTrace{Rule: "not"}
+	case r.Match != nil:
+		return r.Match.traceNode(req)
+	case r.Expression != nil:
+		return &RuleTrace{Rule: "expression", Expression: r.Expression.String()}
+	case r.Ref != "":
+		return &RuleTrace{Rule: "ref", Ref: r.Ref}
+	}
+
+	return &RuleTrace{Rule: "empty"}
+}
+
+// traceNode returns the trace node describing the match rule and the value
+// it is evaluated against.
+func (r *MatchRule) traceNode(req *Request) *RuleTrace {
+	t := &RuleTrace{Rule: "match", Type: r.Type}
+
+	switch r.Type {
+	case IPWhitelist:
+		t.Parameter = "remote-addr"
+		t.Value = req.ClientAddr()
+		return t
+	case MatchTimeWindow:
+		t.Parameter = "time"
+		t.Value = timeNow().Format(time.RFC3339)
+		if r.TimeWindow != nil && r.TimeWindow.location != nil {
+			t.Value = timeNow().In(r.TimeWindow.location).Format(time.RFC3339)
+		}
+		return t
+	case MatchJWT:
+		if r.Parameter.Source == "" {
+			t.Parameter = "header Authorization"
+			t.Value = redact.Mask
+			return t
+		}
+	}
+
+	if r.Parameter.Source == "" {
+		return t
+	}
+
+	t.Parameter = strings.TrimSpace(r.Parameter.Source + " " + r.Parameter.Name)
+	if r.Parameter.Expression != "" {
+		t.Parameter = r.Parameter.Source + " " + r.Parameter.Expression
+	}
+
+	v, err := r.Parameter.Get(req.Redacted())
+
+	switch {
+	case err != nil:
+		t.Value = fmt.Sprintf("(%v)", err)
+	case r.Parameter.IsSensitive() || r.usesSecret():
+		t.Value = redact.Mask
+	default:
+		t.Value = v
+	}
+
+	return t
+}
+
+// usesSecret returns true if the rule checks its parameter against a secret,
+// in which case the parameter value is not included in traces.
+func (r *MatchRule) usesSecret() bool {
+	return r.Secret != "" || r.SecretRef != nil || len(r.Secrets) > 0 || r.Type == MatchJWT
+}
+
+// String formats the trace as an indented tree, one node per line.
+func (t *RuleTrace) String() string {
+	var b strings.Builder
+
+	t.format(&b, 0)
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (t *RuleTrace) format(b *strings.Builder, depth int) {
+	b.WriteString(strings.Repeat("  ", depth))
+	b.WriteString(t.Rule)
+
+	if t.Type != "" {
+		b.WriteString(" " + t.Type)
+	}
+
+	if t.Parameter != "" {
+		fmt.Fprintf(b, " %s=%q", t.Parameter, t.Value)
+	}
+
+	if t.Expression != "" {
+		fmt.Fprintf(b, " %q", t.Expression)
+	}
+
+	if t.Ref != "" {
+		b.WriteString(" " + t.Ref)
+	}
+
+	fmt.Fprintf(b, ": %t", t.Result)
+
+	if t.Error != "" {
+		fmt.Fprintf(b, " (error: %s)", t.Error)
+	}
+
+	b.WriteString("\n")
+
+	for _, c := range t.Children {
+		c.format(b, depth+1)
+	}
+}
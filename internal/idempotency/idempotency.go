@@ -0,0 +1,232 @@
+// Package idempotency remembers the responses to requests carrying
+// idempotency keys, so that repeated deliveries of a request get the original
+// response instead of being processed again.
+package idempotency
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is the default number of keys a Store remembers.
+const DefaultMaxKeys = 10000
+
+// ErrInFlight is returned by Begin if the request with the same key is still
+// being processed.
+var ErrInFlight = errors.New("request with the same idempotency key is in flight")
+
+// Response is a recorded response.
+type Response struct {
+	Status int                 `json:"status"`
+	Header map[string][]string `json:"header,omitempty"`
+	Body   []byte              `json:"body,omitempty"`
+}
+
+type entry struct {
+	Response *Response `json:"response"`
+	Expires  time.Time `json:"expires"`
+
+	ttl time.Duration
+}
+
+// Store remembers the responses to requests by key. It holds a limited
+// number of keys, forgetting expired responses and then the oldest keys
+// first. If it has a path, the recorded
+// responses are saved to the file at the path and loaded when the store is
+// created.
+type Store struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	order   []string
+	max     int
+	path    string
+
+	now func() time.Time
+}
+
+// New returns a store holding up to max keys, or DefaultMaxKeys if max is 0.
+// If path is not empty, the responses saved in the file at path are loaded.
+func New(max int, path string) (*Store, error) {
+	if max <= 0 {
+		max = DefaultMaxKeys
+	}
+
+	s := &Store{
+		entries: make(map[string]*entry),
+		max:     max,
+		path:    path,
+		now:     time.Now,
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]*entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for k, e := range entries {
+		if e != nil && e.Response != nil && s.now().Before(e.Expires) {
+			keys = append(keys, k)
+		}
+	}
+
+	// Add the keys oldest first.
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].Expires.Before(entries[keys[j]].Expires)
+	})
+
+	for _, k := range keys {
+		s.add(k, entries[k])
+	}
+
+	return s, nil
+}
+
+// Begin starts processing the request with the given key, which is
+// remembered for ttl once Finish is called. If a response to a request with
+// the key is recorded, it is returned and the request must not be processed
+// again. If the request with the key is still being processed, ErrInFlight
+// is returned.
+func (s *Store) Begin(key string, ttl time.Duration) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		switch {
+		case e.Response == nil:
+			return nil, ErrInFlight
+		case s.now().Before(e.Expires):
+			return e.Response, nil
+		}
+
+		s.remove(key)
+	}
+
+	s.add(key, &entry{ttl: ttl})
+
+	return nil, nil
+}
+
+// Finish records the response to the request with the given key.
+func (s *Store) Finish(key string, resp *Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	e.Response = resp
+	e.Expires = s.now().Add(e.ttl)
+
+	return s.save()
+}
+
+// Abort forgets the request with the given key, so that it is processed
+// again when it is repeated.
+func (s *Store) Abort(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && e.Response == nil {
+		s.remove(key)
+	}
+}
+
+// add adds the entry, forgetting expired responses and then the oldest keys
+// to stay within the limit.
+func (s *Store) add(key string, e *entry) {
+	if len(s.entries) >= s.max {
+		s.expire(s.now())
+	}
+
+	for len(s.order) > 0 && len(s.entries) >= s.max {
+		s.remove(s.order[0])
+	}
+
+	s.entries[key] = e
+	s.order = append(s.order, key)
+}
+
+// expire forgets the expired responses.
+func (s *Store) expire(now time.Time) {
+	order := s.order[:0]
+
+	for _, k := range s.order {
+		if e := s.entries[k]; e.Response != nil && !now.Before(e.Expires) {
+			delete(s.entries, k)
+			continue
+		}
+
+		order = append(order, k)
+	}
+
+	s.order = order
+}
+
+func (s *Store) remove(key string) {
+	delete(s.entries, key)
+
+	for i := range s.order {
+		if s.order[i] == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// save writes the recorded responses to the store's file.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	entries := make(map[string]*entry, len(s.entries))
+	for k, e := range s.entries {
+		if e.Response != nil {
+			entries[k] = e
+		}
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
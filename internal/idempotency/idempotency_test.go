@@ -0,0 +1,132 @@
+package idempotency
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, _ := New(0, "")
+	s.now = func() time.Time { return now }
+
+	resp, err := s.Begin("a", time.Minute)
+	if resp != nil || err != nil {
+		t.Fatalf("expected new key, got %v, %v", resp, err)
+	}
+
+	if _, err := s.Begin("a", time.Minute); err != ErrInFlight {
+		t.Fatalf("expected ErrInFlight, got %v", err)
+	}
+
+	want := &Response{Status: 200, Body: []byte("done")}
+	if err := s.Finish("a", want); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(30 * time.Second)
+
+	resp, err = s.Begin("a", time.Minute)
+	if err != nil || !reflect.DeepEqual(resp, want) {
+		t.Fatalf("expected recorded response, got %v, %v", resp, err)
+	}
+
+	// The response expires.
+	now = now.Add(30 * time.Second)
+
+	if resp, err := s.Begin("a", time.Minute); resp != nil || err != nil {
+		t.Fatalf("expected expired key, got %v, %v", resp, err)
+	}
+
+	// Aborted requests are processed again.
+	s.Abort("a")
+
+	if resp, err := s.Begin("a", time.Minute); resp != nil || err != nil {
+		t.Fatalf("expected aborted key, got %v, %v", resp, err)
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, _ := New(2, "")
+	s.now = func() time.Time { return now }
+
+	for _, k := range []string{"a", "b"} {
+		s.Begin(k, time.Hour)
+		s.Finish(k, &Response{Status: 200})
+	}
+
+	s.Begin("c", time.Hour)
+
+	if len(s.entries) != 2 {
+		t.Errorf("expected 2 keys, got %d", len(s.entries))
+	}
+
+	// The oldest key is forgotten.
+	if _, ok := s.entries["a"]; ok {
+		t.Error("expected key a to be forgotten")
+	}
+
+	// Expired responses are forgotten before the oldest keys.
+	s.Finish("c", &Response{Status: 200})
+	s.entries["c"].Expires = now
+
+	s.Begin("d", time.Hour)
+
+	if _, ok := s.entries["b"]; !ok {
+		t.Error("expected key b to be kept")
+	}
+	if _, ok := s.entries["c"]; ok {
+		t.Error("expected key c to be forgotten")
+	}
+}
+
+func TestStoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+
+	s, err := New(0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Response{Status: 202, Header: map[string][]string{"X-Test": {"1"}}, Body: []byte("ok")}
+
+	s.Begin("a", time.Hour)
+	s.Finish("a", want)
+	s.Begin("b", time.Hour)
+
+	s, err = New(0, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.Begin("a", time.Hour)
+	if err != nil || !reflect.DeepEqual(resp, want) {
+		t.Errorf("expected saved response, got %v, %v", resp, err)
+	}
+
+	// Requests in flight are not saved.
+	if resp, err := s.Begin("b", time.Hour); resp != nil || err != nil {
+		t.Errorf("expected unsaved key, got %v, %v", resp, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(0, path); err == nil {
+		t.Error("expected error loading invalid file")
+	}
+}
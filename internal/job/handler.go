@@ -39,14 +39,50 @@ func (hookEvtHandler *HookEventHandler) apply(event HookEvent) {
 
 // HandleHook process the hook with coming request
 func HandleHook(h *hook.Hook, r *hook.Request) (string, error) {
+	defer r.RemoveFiles()
+
+	if h.Workspace != hook.WorkspaceEphemeral {
+		return runCommand(h, r, h.CommandWorkingDirectory, nil)
+	}
+
+	workspace, err := createWorkspace(h, r)
+	if err != nil {
+		log.Printf("[%s] error creating workspace: %s", r.ID, err)
+		return "", err
+	}
+
+	log.Printf("[%s] created workspace %s\n", r.ID, workspace)
+
+	out, err := runCommand(h, r, workspace, []string{hook.EnvNamespace + "WORKSPACE=" + workspace})
+
+	if err != nil && h.KeepWorkspaceOnFailure {
+		log.Printf("[%s] keeping workspace %s of failed command\n", r.ID, workspace)
+	} else {
+		log.Printf("[%s] removing workspace %s\n", r.ID, workspace)
+		if rerr := removeWorkspace(workspace); rerr != nil {
+			log.Printf("[%s] error removing workspace %s [%s]", r.ID, workspace, rerr)
+		}
+	}
+
+	return out, err
+}
+
+// runCommand executes the hook's command in dir with the extra environment
+// variables given in env.
+func runCommand(h *hook.Hook, r *hook.Request, dir string, env []string) (string, error) {
 	var errors []error
 
 	// check the command exists
 	var lookpath string
-	if filepath.IsAbs(h.ExecuteCommand) || h.CommandWorkingDirectory == "" {
+	switch {
+	case filepath.IsAbs(h.ExecuteCommand):
 		lookpath = h.ExecuteCommand
-	} else {
+	case h.CommandWorkingDirectory != "":
 		lookpath = filepath.Join(h.CommandWorkingDirectory, h.ExecuteCommand)
+	case dir != "":
+		lookpath = filepath.Join(dir, h.ExecuteCommand)
+	default:
+		lookpath = h.ExecuteCommand
 	}
 
 	cmdPath, err := exec.LookPath(lookpath)
@@ -63,7 +99,7 @@ func HandleHook(h *hook.Hook, r *hook.Request) (string, error) {
 	}
 
 	cmd := exec.Command(cmdPath)
-	cmd.Dir = h.CommandWorkingDirectory
+	cmd.Dir = dir
 
 	cmd.Args, errors = h.ExtractCommandArguments(r)
 	for _, err := range errors {
@@ -72,11 +108,15 @@ func HandleHook(h *hook.Hook, r *hook.Request) (string, error) {
 
 	var envs []string
 	envs, errors = h.ExtractCommandArgumentsForEnv(r)
+	envs = append(envs, env...)
 
 	for _, err := range errors {
 		log.Printf("[%s] error extracting command arguments for environment: %s\n", r.ID, err)
 	}
 
+	// logEnvs mirrors envs with sensitive values masked.
+	logEnvs := append(h.RedactedCommandArgumentsForEnv(r), env...)
+
 	files, errors := h.ExtractCommandArgumentsForFile(r)
 
 	for _, err := range errors {
@@ -84,7 +124,13 @@ func HandleHook(h *hook.Hook, r *hook.Request) (string, error) {
 	}
 
 	for i := range files {
-		tmpfile, err := ioutil.TempFile(h.CommandWorkingDirectory, files[i].EnvName)
+		if files[i].Path != "" {
+			envs = append(envs, files[i].EnvName+"="+files[i].Path)
+			logEnvs = append(logEnvs, files[i].EnvName+"="+files[i].Path)
+			continue
+		}
+
+		tmpfile, err := ioutil.TempFile(dir, files[i].EnvName)
 		if err != nil {
 			log.Printf("[%s] error creating temp file [%s]", r.ID, err)
 			continue
@@ -101,11 +147,12 @@ func HandleHook(h *hook.Hook, r *hook.Request) (string, error) {
 
 		files[i].File = tmpfile
 		envs = append(envs, files[i].EnvName+"="+tmpfile.Name())
+		logEnvs = append(logEnvs, files[i].EnvName+"="+tmpfile.Name())
 	}
 
 	cmd.Env = append(os.Environ(), envs...)
 
-	log.Printf("[%s] executing %s (%s) with arguments %q and environment %s using %s as cwd\n", r.ID, h.ExecuteCommand, cmd.Path, cmd.Args, envs, cmd.Dir)
+	log.Printf("[%s] executing %s (%s) with arguments %q and environment %s using %s as cwd\n", r.ID, h.ExecuteCommand, cmd.Path, h.RedactedCommandArguments(r), logEnvs, cmd.Dir)
 
 	out, err := cmd.CombinedOutput()
 
@@ -0,0 +1,133 @@
+package job
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/adnanh/webhook/internal/hook"
+)
+
+// unsafePathChars matches characters that should not be used in workspace
+// directory names.
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// createWorkspace creates a new, empty workspace directory for a single
+// execution of the hook and seeds it with the contents of the hook's
+// workspace template, if any.
+func createWorkspace(h *hook.Hook, r *hook.Request) (string, error) {
+	prefix := unsafePathChars.ReplaceAllString("webhook-"+h.ID+"-"+r.ID, "-") + "-"
+
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		return "", err
+	}
+
+	if h.WorkspaceTemplate != "" {
+		err = copyDir(h.WorkspaceTemplate, dir)
+		if err != nil {
+			removeWorkspace(dir)
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+// removeWorkspace removes the workspace directory dir, making the directories
+// copied from read-only template directories writable first.
+func removeWorkspace(dir string) error {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && fi.Mode().Perm()&0700 != 0700 {
+			os.Chmod(path, fi.Mode().Perm()|0700)
+		}
+
+		return nil
+	})
+
+	return os.RemoveAll(dir)
+}
+
+// copyDir recursively copies the contents of the src directory into the
+// existing dst directory. Symbolic links are copied as links.
+//
+// Directories are created writable, so that read-only directories can be
+// filled, and get the permissions of their source once everything is copied.
+func copyDir(src, dst string) error {
+	type dirPerm struct {
+		path string
+		perm os.FileMode
+	}
+
+	var dirs []dirPerm
+
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			if rel == "." {
+				return nil
+			}
+			dirs = append(dirs, dirPerm{target, fi.Mode().Perm()})
+			return os.Mkdir(target, 0700)
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case fi.Mode().IsRegular():
+			return copyFile(path, target, fi.Mode().Perm())
+		}
+
+		// Skip devices, sockets and other special files.
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Walk visits directories before their contents, so set the
+	// permissions of the deepest directories first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Key to use when setting the client address.
+type ctxKeyClientAddr int
+
+// ClientAddrKey is the key that holds the client address in a request context.
+const ClientAddrKey ctxKeyClientAddr = 0
+
+// ClientIP is a middleware that injects the address of the client that sent
+// each request into its context. If the request was received from one of the
+// trusted proxies, the client address is taken from the X-Forwarded-For,
+// Forwarded or X-Real-IP header, skipping any further trusted proxies;
+// otherwise it is the remote address of the request.
+func ClientIP(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := clientAddr(r, trustedProxies)
+
+			ctx := context.WithValue(r.Context(), ClientAddrKey, addr)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// GetClientAddr returns the client address from the given context if one is
+// present, or the remote address of the request otherwise.
+func GetClientAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(ClientAddrKey).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and
+// ranges in CIDR notation.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", v)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q", v)
+		}
+
+		res = append(res, cidr)
+	}
+
+	return res, nil
+}
+
+// clientAddr returns the address of the client that sent r.
+func clientAddr(r *http.Request, trusted []*net.IPNet) string {
+	if len(trusted) == 0 || !isTrusted(parseAddr(r.RemoteAddr), trusted) {
+		return r.RemoteAddr
+	}
+
+	var chain []string
+
+	switch {
+	case r.Header.Get("X-Forwarded-For") != "":
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+
+	case r.Header.Get("Forwarded") != "":
+		for _, v := range r.Header.Values("Forwarded") {
+			chain = append(chain, forwardedFor(v)...)
+		}
+
+	case r.Header.Get("X-Real-Ip") != "":
+		chain = []string{r.Header.Get("X-Real-Ip")}
+	}
+
+	addr := r.RemoteAddr
+
+	// Walk the chain from the proxy closest to us towards the client and
+	// stop at the first address that is not a trusted proxy.
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseAddr(chain[i])
+		if ip == nil {
+			break
+		}
+
+		addr = ip.String()
+
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+
+	return addr
+}
+
+// forwardedFor returns the for parameters of a Forwarded header value, as
+// defined in RFC 7239.
+func forwardedFor(v string) []string {
+	var res []string
+
+	for _, elem := range strings.Split(v, ",") {
+		for _, pair := range strings.Split(elem, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				res = append(res, strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+
+	return res
+}
+
+// parseAddr parses an IP address with an optional port, as found in the
+// remote address of a request or in forwarding headers.
+func parseAddr(s string) net.IP {
+	s = strings.TrimSpace(s)
+
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// isTrusted returns true if ip is in any of the trusted ranges.
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
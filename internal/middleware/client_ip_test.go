@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		desc       string
+		remoteAddr string
+		headers    map[string][]string
+		expect     string
+	}{
+		{"untrusted peer", "198.51.100.1:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, "198.51.100.1:1234"},
+		{"no headers", "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"x-forwarded-for", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		{"spoofed x-forwarded-for", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 203.0.113.7, 10.0.0.2"}}, "203.0.113.7"},
+		{"multiple x-forwarded-for headers", "192.0.2.1:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.7", "10.0.0.2"}}, "203.0.113.7"},
+		{"all trusted", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"invalid entry", "10.0.0.1:1234", map[string][]string{"X-Forwarded-For": {"203.0.113.7, garbage"}}, "10.0.0.1:1234"},
+		{"forwarded", "[fd00::1]:1234", map[string][]string{"Forwarded": {`for="[2001:db8::7]:4711";proto=https, for=10.0.0.2`}}, "2001:db8::7"},
+		{"x-real-ip", "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"203.0.113.7"}}, "203.0.113.7"},
+	} {
+		var got string
+
+		h := ClientIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = GetClientAddr(r)
+		}))
+
+		r := httptest.NewRequest("POST", "/hooks/test", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.headers {
+			r.Header[k] = v
+		}
+
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != tt.expect {
+			t.Errorf("%s: expected client address %q, got %q", tt.desc, tt.expect, got)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected error for invalid range")
+	}
+}
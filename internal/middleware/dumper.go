@@ -8,11 +8,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"sort"
 	"strings"
+
+	"github.com/adnanh/webhook/internal/redact"
 )
 
 // responseDupper tees the response to a buffer and a response writer.
@@ -24,20 +27,50 @@ type responseDupper struct {
 
 // Dumper returns a debug middleware which prints detailed information about
 // incoming requests and outgoing responses including all headers, parameters
-// and bodies.
-func Dumper(w io.Writer) func(http.Handler) http.Handler {
+// and bodies. Request bodies larger than the number of bytes returned by
+// maxBody for the request are not printed, and are passed on to the handler
+// as they are, unless maxBody returns 0.
+func Dumper(w io.Writer, maxBody func(r *http.Request) int64) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 			buf := &bytes.Buffer{}
 			// Request ID
 			rid := r.Context().Value(RequestIDKey)
+			limit := maxBody(r)
+
+			// Dump request, masking redacted headers and payload values
+
+			var src io.Reader = r.Body
+			if limit > 0 {
+				src = io.LimitReader(r.Body, limit+1)
+			}
+
+			body, err := ioutil.ReadAll(src)
+			if err != nil {
+				buf.WriteString(fmt.Sprintf("[%s] Error reading request body for debugging: %s\n", rid, err))
+			}
+
+			tooLarge := limit > 0 && int64(len(body)) > limit
+
+			// Pass the rest of a large body on, for the handler to reject.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+			if tooLarge {
+				buf.WriteString(fmt.Sprintf("[%s] Request body is larger than %d bytes, not dumping it\n", rid, limit))
+				body = nil
+			}
 
-			// Dump request
+			dr := r.Clone(r.Context())
+			dr.Header = redact.Header(r.Header)
 
-			bd, err := httputil.DumpRequest(r, true)
+			bd, err := httputil.DumpRequest(dr, false)
 			if err != nil {
 				buf.WriteString(fmt.Sprintf("[%s] Error dumping request for debugging: %s\n", rid, err))
 			}
+			bd = append(bd, redact.Body(body, r.Header.Get("Content-Type"))...)
 
 			sc := bufio.NewScanner(bytes.NewBuffer(bd))
 			sc.Split(bufio.ScanLines)
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDumper(t *testing.T) {
+	for _, tt := range []struct {
+		body   string
+		max    int64
+		dumped bool
+	}{
+		{"0123456789", 10, true},
+		{"0123456789a", 10, false},
+		{"0123456789a", 0, true},
+	} {
+		var got []byte
+
+		max := tt.max
+		out := &bytes.Buffer{}
+		h := Dumper(out, func(r *http.Request) int64 { return max })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = ioutil.ReadAll(r.Body)
+		}))
+
+		r := httptest.NewRequest("POST", "/hooks/test", strings.NewReader(tt.body))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		// The handler gets the whole body either way.
+		if string(got) != tt.body {
+			t.Errorf("%s: expected handler to read %q, got %q", tt.body, tt.body, got)
+		}
+
+		if dumped := strings.Contains(out.String(), tt.body); dumped != tt.dumped {
+			t.Errorf("%s: expected dumped %t, got:\n%s", tt.body, tt.dumped, out)
+		}
+	}
+}
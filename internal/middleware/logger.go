@@ -45,7 +45,7 @@ func (l *LogEntry) Write(status, totalBytes int, elapsed time.Duration) {
 		fmt.Fprintf(l.buf, "[%s] ", rid)
 	}
 
-	fmt.Fprintf(l.buf, "%03d | %s | %s | ", status, humanize.IBytes(uint64(totalBytes)), elapsed)
+	fmt.Fprintf(l.buf, "%03d | %s | %s | %s | ", status, humanize.IBytes(uint64(totalBytes)), elapsed, GetClientAddr(l.req))
 	l.buf.WriteString(l.req.Host + " | " + l.req.Method + " " + l.req.RequestURI)
 	log.Print(l.buf.String())
 }
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/adnanh/webhook/internal/ratelimit"
+)
+
+// RateLimit is a middleware that limits the rate of requests per client IP
+// address, as set by the ClientIP middleware. Requests over the limit get a
+// 429 Too Many Requests response with a Retry-After header.
+func RateLimit(l *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := GetClientAddr(r)
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+
+			if ok, wait := l.Allow(addr); !ok {
+				log.Printf("[%s] rate limit exceeded for client %s", GetReqID(r.Context()), addr)
+
+				w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, "Too many requests.")
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adnanh/webhook/internal/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	h := RateLimit(ratelimit.New(1, time.Hour, 0))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tt := range []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"198.51.100.1:1234", http.StatusNoContent},
+		{"198.51.100.1:4321", http.StatusTooManyRequests},
+		{"198.51.100.2:1234", http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/hooks/test", nil)
+		r.RemoteAddr = tt.remoteAddr
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.remoteAddr, tt.status, w.Code)
+		}
+
+		if tt.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "3600" {
+			t.Errorf("%s: expected Retry-After 3600, got %q", tt.remoteAddr, w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package ratelimit limits the rate of requests with token buckets.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxKeys is the number of keys a Limiter tracks before it starts to
+// forget idle keys.
+const DefaultMaxKeys = 10000
+
+// Limiter limits the rate of events per key. Each key has a token bucket
+// holding up to burst tokens, refilled at a rate of requests per interval.
+type Limiter struct {
+	// MaxKeys is the maximum number of keys tracked. It defaults to
+	// DefaultMaxKeys.
+	MaxKeys int
+
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter allowing requests events per interval, with bursts of
+// up to burst events. If burst is 0, it defaults to requests.
+func New(requests int, interval time.Duration, burst int) *Limiter {
+	if burst <= 0 {
+		burst = requests
+	}
+
+	return &Limiter{
+		rate:    float64(requests) / interval.Seconds(),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow consumes a token for key. It returns false if there is no token left,
+// along with the time until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		l.evict(now)
+
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+
+	return false, wait
+}
+
+// evict makes room for a new key by forgetting the keys whose buckets have
+// refilled, and so are in the same state as new ones. If all buckets are in
+// use, an arbitrary key is forgotten.
+func (l *Limiter) evict(now time.Time) {
+	max := l.MaxKeys
+	if max <= 0 {
+		max = DefaultMaxKeys
+	}
+
+	if len(l.buckets) < max {
+		return
+	}
+
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+
+	for k := range l.buckets {
+		if len(l.buckets) < max {
+			break
+		}
+
+		delete(l.buckets, k)
+	}
+}
+
+// RetryAfter formats the wait returned by Allow as the value of a
+// Retry-After header, in whole seconds.
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// ParseRate parses a rate such as "100/1m", meaning 100 requests per minute,
+// or "10/s". The interval defaults to one second.
+func ParseRate(s string) (int, time.Duration, error) {
+	p := strings.SplitN(s, "/", 2)
+
+	n, err := strconv.Atoi(strings.TrimSpace(p[0]))
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate %q: the number of requests must be a positive integer", s)
+	}
+
+	if len(p) == 1 {
+		return n, time.Second, nil
+	}
+
+	v := strings.TrimSpace(p[1])
+	if v != "" && (v[0] < '0' || v[0] > '9') {
+		// Allow units without a number, such as "10/m".
+		v = "1" + v
+	}
+
+	interval, err := time.ParseDuration(v)
+	if err == nil && interval <= 0 {
+		err = errors.New("must be positive")
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rate %q: invalid interval: %v", s, err)
+	}
+
+	return n, interval, nil
+}
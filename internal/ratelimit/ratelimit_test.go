@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l := New(2, time.Minute, 3)
+	l.now = func() time.Time { return now }
+
+	for i, tt := range []struct {
+		key     string
+		advance time.Duration
+		ok      bool
+		wait    time.Duration
+	}{
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, 30 * time.Second},
+		{"b", 0, true, 0},
+		{"a", 20 * time.Second, false, 10 * time.Second},
+		{"a", 10 * time.Second, true, 0},
+		{"a", 0, false, 30 * time.Second},
+		{"a", 10 * time.Minute, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, 30 * time.Second},
+	} {
+		now = now.Add(tt.advance)
+
+		ok, wait := l.Allow(tt.key)
+		if ok != tt.ok || wait.Round(time.Millisecond) != tt.wait {
+			t.Errorf("%d: expected %t (wait %s), got %t (wait %s)", i, tt.ok, tt.wait, ok, wait)
+		}
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l := New(1, time.Minute, 1)
+	l.MaxKeys = 2
+	l.now = func() time.Time { return now }
+
+	l.Allow("a")
+	l.Allow("b")
+	l.Allow("c")
+
+	if len(l.buckets) > 2 {
+		t.Errorf("expected at most 2 keys, got %d", len(l.buckets))
+	}
+
+	// Idle keys are forgotten first.
+	now = now.Add(time.Minute)
+	l.Allow("d")
+	l.Allow("d")
+	l.Allow("e")
+
+	if _, ok := l.buckets["d"]; !ok || len(l.buckets) != 2 {
+		t.Errorf("expected the exhausted key to be kept, got %v", l.buckets)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, tt := range []struct {
+		s        string
+		n        int
+		interval time.Duration
+		err      bool
+	}{
+		{"100/1m", 100, time.Minute, false},
+		{"10/s", 10, time.Second, false},
+		{"5", 5, time.Second, false},
+		{" 60 / h ", 60, time.Hour, false},
+		{"0/1m", 0, 0, true},
+		{"x/1m", 0, 0, true},
+		{"10/forever", 0, 0, true},
+		{"10/-1m", 0, 0, true},
+	} {
+		n, interval, err := ParseRate(tt.s)
+		if n != tt.n || interval != tt.interval || (err != nil) != tt.err {
+			t.Errorf("%q: expected %d/%s (error %t), got %d/%s (%v)", tt.s, tt.n, tt.interval, tt.err, n, interval, err)
+		}
+	}
+
+	if got := RetryAfter(1500 * time.Millisecond); got != "2" {
+		t.Errorf("expected Retry-After 2, got %s", got)
+	}
+}
@@ -0,0 +1,279 @@
+// Package redact masks sensitive request values, such as credentials and
+// signatures, before they are written to logs or debug dumps.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Mask is the value that replaces redacted values.
+const Mask = "[redacted]"
+
+// DefaultHeaders is the list of header names that are always redacted.
+var DefaultHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+	"Stripe-Signature",
+	"X-Gitea-Signature",
+	"X-Gitlab-Token",
+	"X-Gogs-Signature",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Signature",
+	"X-Signature-Ed25519",
+	"X-Slack-Signature",
+}
+
+var (
+	mu           sync.RWMutex
+	headers      = make(map[string]bool)
+	payloadPaths []string
+)
+
+func init() {
+	AddHeaders(DefaultHeaders...)
+}
+
+// AddHeaders adds names to the list of redacted header names.
+func AddHeaders(names ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, name := range names {
+		headers[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+	}
+}
+
+// AddPayloadPaths adds paths, in the dot-notation used to reference payload
+// values, to the list of redacted payload paths.
+func AddPayloadPaths(paths ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, path := range paths {
+		payloadPaths = append(payloadPaths, strings.TrimSpace(path))
+	}
+}
+
+// IsHeader returns true if the named header is redacted.
+func IsHeader(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return headers[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// IsPayloadPath returns true if the payload value at path, or any value
+// within it, is redacted.
+func IsPayloadPath(path string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for _, p := range payloadPaths {
+		if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPayloadPaths returns true if any payload paths are redacted.
+func HasPayloadPaths() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return len(payloadPaths) > 0
+}
+
+// Header returns a copy of h with the values of redacted headers masked.
+func Header(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+
+	for k, v := range h {
+		if IsHeader(k) {
+			res[k] = []string{Mask}
+			continue
+		}
+
+		res[k] = v
+	}
+
+	return res
+}
+
+// HeaderMap returns a copy of the parsed headers m with the values of
+// redacted headers masked.
+func HeaderMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	res := make(map[string]interface{}, len(m))
+
+	for k, v := range m {
+		if IsHeader(k) {
+			res[k] = Mask
+			continue
+		}
+
+		res[k] = v
+	}
+
+	return res
+}
+
+// Payload returns a copy of the parsed payload m with the values at redacted
+// payload paths masked. Only the parts of m along redacted paths are copied.
+func Payload(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	mu.RLock()
+	paths := payloadPaths
+	mu.RUnlock()
+
+	var v interface{} = m
+	for _, p := range paths {
+		v = maskPath(v, p)
+	}
+
+	return v.(map[string]interface{})
+}
+
+// Body returns a copy of the raw request body b with the values at redacted
+// payload paths masked. Only JSON and form-encoded bodies are inspected;
+// other bodies are returned unchanged.
+func Body(b []byte, contentType string) []byte {
+	if !HasPayloadPaths() || len(b) == 0 {
+		return b
+	}
+
+	switch {
+	case strings.Contains(contentType, "json"):
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+
+		var payload map[string]interface{}
+		if err := decoder.Decode(&payload); err != nil {
+			return b
+		}
+
+		res, err := json.Marshal(Payload(payload))
+		if err != nil {
+			return b
+		}
+
+		return res
+
+	case strings.Contains(contentType, "x-www-form-urlencoded"):
+		fd, err := url.ParseQuery(string(b))
+		if err != nil {
+			return b
+		}
+
+		for k := range fd {
+			if IsPayloadPath(k) {
+				fd[k] = []string{Mask}
+			}
+		}
+
+		return []byte(fd.Encode())
+	}
+
+	return b
+}
+
+// maskPath returns a copy of v with the value at the dot-notation path
+// replaced with Mask. If the path does not exist, v is returned unchanged.
+func maskPath(v interface{}, path string) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		// Raw keys take priority over dotted references, as in
+		// hook.GetParameter.
+		key, rest := path, ""
+		if _, ok := node[path]; !ok {
+			p := strings.SplitN(path, ".", 2)
+			if len(p) > 1 {
+				key, rest = p[0], p[1]
+			}
+		}
+
+		child, ok := node[key]
+		if !ok {
+			return v
+		}
+
+		res := make(map[string]interface{}, len(node))
+		for k, v := range node {
+			res[k] = v
+		}
+
+		if rest == "" {
+			res[key] = Mask
+		} else {
+			res[key] = maskPath(child, rest)
+		}
+
+		return res
+
+	case []interface{}:
+		p := strings.SplitN(path, ".", 2)
+
+		index, err := strconv.Atoi(p[0])
+		if err != nil || index < 0 || index >= len(node) {
+			return v
+		}
+
+		res := make([]interface{}, len(node))
+		copy(res, node)
+
+		if len(p) == 1 {
+			res[index] = Mask
+		} else {
+			res[index] = maskPath(node[index], p[1])
+		}
+
+		return res
+	}
+
+	return v
+}
+
+// HeadersFlag is a flag.Value that adds comma-separated header names to the
+// list of redacted headers.
+type HeadersFlag struct{}
+
+func (HeadersFlag) String() string {
+	return ""
+}
+
+// Set adds the header names in value to the list of redacted headers.
+func (HeadersFlag) Set(value string) error {
+	AddHeaders(strings.Split(value, ",")...)
+	return nil
+}
+
+// PayloadPathsFlag is a flag.Value that adds comma-separated payload paths to
+// the list of redacted payload paths.
+type PayloadPathsFlag struct{}
+
+func (PayloadPathsFlag) String() string {
+	return ""
+}
+
+// Set adds the payload paths in value to the list of redacted payload paths.
+func (PayloadPathsFlag) Set(value string) error {
+	AddPayloadPaths(strings.Split(value, ",")...)
+	return nil
+}
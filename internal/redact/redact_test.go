@@ -0,0 +1,93 @@
+package redact
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	h := http.Header{
+		"Authorization":       []string{"Bearer secret"},
+		"Content-Type":        []string{"application/json"},
+		"Stripe-Signature":    []string{"t=1,v1=secret"},
+		"X-Signature-Ed25519": []string{"secret"},
+		"X-Slack-Signature":   []string{"v0=secret"},
+	}
+
+	res := Header(h)
+
+	if res.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected redacted headers: %#v", res)
+	}
+
+	for _, k := range []string{"Authorization", "Stripe-Signature", "X-Signature-Ed25519", "X-Slack-Signature"} {
+		if res.Get(k) != Mask {
+			t.Errorf("expected %s to be redacted: %#v", k, res)
+		}
+	}
+
+	if h.Get("Authorization") != "Bearer secret" {
+		t.Errorf("original headers modified: %#v", h)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	AddPayloadPaths("user.token", "keys.1", "a.b")
+	defer func() { payloadPaths = nil }()
+
+	payload := map[string]interface{}{
+		"user": map[string]interface{}{"name": "bob", "token": "s3cret"},
+		"keys": []interface{}{"k0", "k1"},
+		"a.b":  "raw",
+		"ref":  "main",
+	}
+
+	expect := map[string]interface{}{
+		"user": map[string]interface{}{"name": "bob", "token": Mask},
+		"keys": []interface{}{"k0", Mask},
+		"a.b":  Mask,
+		"ref":  "main",
+	}
+
+	res := Payload(payload)
+	if !reflect.DeepEqual(res, expect) {
+		t.Errorf("unexpected redacted payload:\nexpected %#v\ngot %#v", expect, res)
+	}
+
+	if payload["user"].(map[string]interface{})["token"] != "s3cret" || payload["a.b"] != "raw" {
+		t.Errorf("original payload modified: %#v", payload)
+	}
+
+	for _, tt := range []struct {
+		path string
+		ok   bool
+	}{
+		{"user.token", true},
+		{"user", true},
+		{"user.token.x", true},
+		{"user.name", false},
+		{"ref", false},
+	} {
+		if ok := IsPayloadPath(tt.path); ok != tt.ok {
+			t.Errorf("IsPayloadPath(%q): expected %v, got %v", tt.path, tt.ok, ok)
+		}
+	}
+}
+
+func TestBody(t *testing.T) {
+	AddPayloadPaths("token")
+	defer func() { payloadPaths = nil }()
+
+	for _, tt := range []struct {
+		body, contentType, expect string
+	}{
+		{`{"token":"s3cret","n":1}`, "application/json", `{"n":1,"token":"[redacted]"}`},
+		{`token=s3cret&n=1`, "application/x-www-form-urlencoded", `n=1&token=%5Bredacted%5D`},
+		{`token=s3cret`, "text/plain", `token=s3cret`},
+	} {
+		if res := string(Body([]byte(tt.body), tt.contentType)); res != tt.expect {
+			t.Errorf("unexpected redacted %s body: expected %s, got %s", tt.contentType, tt.expect, res)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	"github.com/adnanh/webhook/internal/hook"
+)
+
+// maxMultipartValues is the size of the form values of a multipart request
+// allowed in addition to -max-multipart-mem, as with
+// http.Request.ParseMultipartForm.
+const maxMultipartValues = 10 << 20
+
+// parseMultipart streams the parts of the multipart request r into req. Form
+// values are added to the payload, and files are saved to disk. Files sent as
+// JSON, or named by the hook's parse-parameters-as-json, are also parsed into
+// the payload.
+func parseMultipart(h *hook.Hook, req *hook.Request, r *http.Request) error {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		log.Printf("[%s] error parsing multipart form: %+v\n", req.ID, err)
+		return requestError("Error occurred while parsing multipart form.")
+	}
+
+	values := make(map[string][]string)
+	jsonParts := make(map[string][]interface{})
+	valuesLeft := *maxMultipartMem + maxMultipartValues
+	fileCount := 0
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[%s] error parsing multipart form: %+v\n", req.ID, err)
+			return requestError("Error occurred while parsing multipart form.")
+		}
+
+		k := p.FormName()
+		if k == "" {
+			continue
+		}
+
+		if p.FileName() == "" {
+			b, err := ioutil.ReadAll(io.LimitReader(p, valuesLeft+1))
+			if err != nil {
+				log.Printf("[%s] error parsing multipart form: %+v\n", req.ID, err)
+				return requestError("Error occurred while parsing multipart form.")
+			}
+
+			valuesLeft -= int64(len(b))
+			if valuesLeft < 0 {
+				log.Printf("[%s] multipart form values are too large\n", req.ID)
+				return requestTooLargeError("Multipart form values are too large.")
+			}
+
+			log.Printf("[%s] found multipart form value %q", req.ID, k)
+			values[k] = append(values[k], string(b))
+
+			continue
+		}
+
+		fileCount++
+		if h.MaxMultipartFiles > 0 && fileCount > h.MaxMultipartFiles {
+			log.Printf("[%s] multipart form has more than %d files\n", req.ID, h.MaxMultipartFiles)
+			return requestTooLargeError(fmt.Sprintf("Multipart form has more than %d files.", h.MaxMultipartFiles))
+		}
+
+		f, err := saveMultipartFile(req, p, h.MaxMultipartFileSize)
+		if err != nil {
+			return err
+		}
+
+		if !parseFileAsJSON(h, p) {
+			continue
+		}
+
+		log.Printf("[%s] parsing multipart form file %q as JSON\n", req.ID, k)
+
+		part, err := decodeJSONFile(f.Path)
+		if err != nil {
+			log.Printf("[%s] error parsing JSON payload file: %+v\n", req.ID, err)
+		}
+
+		jsonParts[k] = append(jsonParts[k], part)
+	}
+
+	if len(values) != 0 {
+		req.Payload = hook.ValuesToMap(values)
+	}
+
+	for k, v := range jsonParts {
+		if req.Payload == nil {
+			req.Payload = make(map[string]interface{})
+		}
+
+		if len(v) == 1 {
+			req.Payload[k] = v[0]
+		} else {
+			req.Payload[k] = hook.RepeatedValues(v)
+		}
+	}
+
+	return nil
+}
+
+// saveMultipartFile streams the file in the part p to disk and records it in
+// req. Files larger than max bytes are rejected, unless max is 0.
+func saveMultipartFile(req *hook.Request, p *multipart.Part, max int64) (*hook.File, error) {
+	tmp, err := ioutil.TempFile("", "webhook-upload-")
+	if err != nil {
+		log.Printf("[%s] error creating file for multipart form file %q: %+v\n", req.ID, p.FormName(), err)
+		return nil, requestError("Error occurred while saving multipart form file.")
+	}
+
+	f := &hook.File{
+		Field:       p.FormName(),
+		Filename:    p.FileName(),
+		ContentType: p.Header.Get("Content-Type"),
+		Path:        tmp.Name(),
+	}
+
+	// Record the file first, so that it is removed on errors.
+	req.AddFile(f)
+
+	var src io.Reader = p
+	if max > 0 {
+		src = io.LimitReader(p, max+1)
+	}
+
+	f.Size, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		log.Printf("[%s] error saving multipart form file %q: %+v\n", req.ID, f.Field, err)
+		return nil, requestError("Error occurred while saving multipart form file.")
+	}
+
+	if max > 0 && f.Size > max {
+		log.Printf("[%s] multipart form file %q is larger than %d bytes\n", req.ID, f.Field, max)
+		return nil, requestTooLargeError(fmt.Sprintf("Multipart form file is larger than %d bytes.", max))
+	}
+
+	log.Printf("[%s] saved multipart form file %q (%s, %d bytes) to %s\n", req.ID, f.Field, f.Filename, f.Size, f.Path)
+
+	return f, nil
+}
+
+// parseFileAsJSON returns true if the file in the part p is parsed as JSON.
+func parseFileAsJSON(h *hook.Hook, p *multipart.Part) bool {
+	// Force parsing as JSON regardless of Content-Type.
+	for _, j := range h.JSONStringParameters {
+		if j.Source == hook.SourcePayload && j.Name == p.FormName() {
+			return true
+		}
+	}
+
+	// MIME encoding can contain duplicate headers, so check them all.
+	for _, v := range p.Header["Content-Type"] {
+		if v == "application/json" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeJSONFile decodes the JSON object in the file at path.
+func decodeJSONFile(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+
+	var part map[string]interface{}
+	err = decoder.Decode(&part)
+
+	return part, err
+}
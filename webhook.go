@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,13 +13,17 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"strings"
 	"time"
 
 	"github.com/adnanh/webhook/internal/hook"
+	"github.com/adnanh/webhook/internal/idempotency"
 	"github.com/adnanh/webhook/internal/job"
 	"github.com/adnanh/webhook/internal/middleware"
 	"github.com/adnanh/webhook/internal/pidfile"
+	"github.com/adnanh/webhook/internal/ratelimit"
+	"github.com/adnanh/webhook/internal/redact"
 
 	chimiddleware "github.com/go-chi/chi/middleware"
 	"github.com/gorilla/mux"
@@ -25,6 +32,9 @@ import (
 
 const (
 	version = "2.8.1"
+
+	// adminTokenHeader is the request header carrying the -admin-token.
+	adminTokenHeader = "X-Webhook-Admin-Token"
 )
 
 var (
@@ -46,20 +56,34 @@ var (
 	tlsCipherSuites    = flag.String("cipher-suites", "", "comma-separated list of supported TLS cipher suites")
 	useXRequestID      = flag.Bool("x-request-id", false, "use X-Request-Id header, if present, as request ID")
 	xRequestIDLimit    = flag.Int("x-request-id-limit", 0, "truncate X-Request-Id header to limit; default no limit")
-	maxMultipartMem    = flag.Int64("max-multipart-mem", 1<<20, "maximum memory in bytes for parsing multipart form data before disk caching")
+	maxMultipartMem    = flag.Int64("max-multipart-mem", 1<<20, "maximum memory in bytes for parsing multipart form values; uploaded files are saved to disk")
 	setGID             = flag.Int("setgid", 0, "set group ID after opening listening port; must be used with setuid")
 	setUID             = flag.Int("setuid", 0, "set user ID after opening listening port; must be used with setgid")
 	httpMethods        = flag.String("http-methods", "", `set default allowed HTTP methods (ie. "POST"); separate methods with comma`)
 	pidPath            = flag.String("pidfile", "", "create PID file at the given path")
+	trustedProxies     = flag.String("trusted-proxies", "", "comma-separated list of IP addresses and CIDR ranges of proxies trusted to set the X-Forwarded-For, Forwarded and X-Real-IP headers")
+	adminToken         = flag.String("admin-token", "", "token that, when sent in the X-Webhook-Admin-Token header, returns the rule evaluation trace of hooks with debug-rules set")
+	dryRun             = flag.String("dry-run", "", "evaluate the trigger rules of the given hook against the request read from -dry-run-request, print the rule evaluation trace and exit")
+	ipRateLimit        = flag.String("ip-rate-limit", "", `limit the rate of requests per client IP address (ie. "100/1m" for 100 requests per minute)`)
+	dryRunRequest      = flag.String("dry-run-request", "-", "path to the raw HTTP request evaluated by -dry-run; - reads the request from standard input")
+	dryRunRemoteAddr   = flag.String("dry-run-remote-addr", "127.0.0.1:0", "client address of the request evaluated by -dry-run, as matched by ip-whitelist rules")
+	maxBody            = flag.Int64("max-body-size", 32<<20, "maximum size in bytes of request bodies; hooks can override it with max-body-size; 0 means no limit")
+	maxDecompressed    = flag.Int64("max-decompressed-size", 32<<20, "maximum size in bytes of a compressed request body once decompressed; 0 means no limit")
+	idempotencyFile    = flag.String("idempotency-file", "", "path to the file the responses to requests with idempotency keys are saved to, so that they are remembered across restarts")
 
 	responseHeaders hook.ResponseHeaders
 	hooksFiles      hook.HooksFiles
 
 	loadedHooksFromFiles = make(map[string]hook.Hooks)
 
+	// rulesFiles maps hooks files to the rules files they load.
+	rulesFiles = make(map[string]string)
+
 	watcher *fsnotify.Watcher
 	signals chan os.Signal
 	pidFile *pidfile.PIDFile
+
+	idempotencyStore *idempotency.Store
 )
 
 func matchLoadedHook(id string) *hook.Hook {
@@ -84,6 +108,8 @@ func lenLoadedHooks() int {
 func main() {
 	flag.Var(&hooksFiles, "hooks", "path to the json file containing defined hooks the webhook should serve, use multiple times to load from different files")
 	flag.Var(&responseHeaders, "header", "response header to return, specified in format name=value, use multiple times to set multiple headers")
+	flag.Var(redact.HeadersFlag{}, "redact-header", "header whose value is masked in logs in addition to the default credential and signature headers; separate names with comma or use multiple times")
+	flag.Var(redact.PayloadPathsFlag{}, "redact-payload", "payload value (ie. user.token) that is masked in logs; separate paths with comma or use multiple times")
 
 	flag.Parse()
 
@@ -106,6 +132,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	proxies, err := middleware.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	var ipLimiter *ratelimit.Limiter
+	if *ipRateLimit != "" {
+		n, interval, err := ratelimit.ParseRate(*ipRateLimit)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+
+		ipLimiter = ratelimit.New(n, interval, 0)
+	}
+
+	redact.AddHeaders(adminTokenHeader)
+
 	if *debug || *logPath != "" {
 		*verbose = true
 	}
@@ -114,6 +159,10 @@ func main() {
 		hooksFiles = append(hooksFiles, "hooks.json")
 	}
 
+	if *dryRun != "" {
+		os.Exit(runDryRun(os.Stdout, *dryRun, *dryRunRequest, *dryRunRemoteAddr))
+	}
+
 	// logQueue is a queue for log messages encountered during startup. We need
 	// to queue the messages so that we can handle any privilege dropping and
 	// log file opening prior to writing our first log message.
@@ -181,6 +230,11 @@ func main() {
 
 	log.Println("version " + version + " starting")
 
+	idempotencyStore, err = idempotency.New(0, *idempotencyFile)
+	if err != nil {
+		log.Fatalf("Error loading idempotency file: %v", err)
+	}
+
 	// set os signal watcher
 	//setupSignals()
 	var maxWorkers uint32 = 4
@@ -193,11 +247,15 @@ func main() {
 
 		newHooks := hook.Hooks{}
 
-		err := newHooks.LoadFromFile(hooksFilePath, *asTemplate)
+		rulesFilePath, err := newHooks.LoadFromFileWithRulesFile(hooksFilePath, *asTemplate)
 
 		if err != nil {
 			log.Printf("couldn't load hooks from file! %+v\n", err)
 		} else {
+			if rulesFilePath != "" {
+				rulesFiles[hooksFilePath] = rulesFilePath
+			}
+
 			log.Printf("found %d hook(s) in file\n", len(newHooks))
 
 			for _, hook := range newHooks {
@@ -243,6 +301,10 @@ func main() {
 				log.Print("error adding hooks file to the watcher\n", err)
 				return
 			}
+
+			if rulesFilePath := rulesFiles[hooksFilePath]; rulesFilePath != "" {
+				watchRulesFile(rulesFilePath)
+			}
 		}
 
 		go watchForFileChange()
@@ -254,11 +316,16 @@ func main() {
 		middleware.UseXRequestIDHeaderOption(*useXRequestID),
 		middleware.XRequestIDLimitOption(*xRequestIDLimit),
 	))
+	r.Use(middleware.ClientIP(proxies))
 	r.Use(middleware.NewLogger())
 	r.Use(chimiddleware.Recoverer)
 
+	if ipLimiter != nil {
+		r.Use(middleware.RateLimit(ipLimiter))
+	}
+
 	if *debug {
-		r.Use(middleware.Dumper(log.Writer()))
+		r.Use(middleware.Dumper(log.Writer(), dumpedBodySize))
 	}
 
 	// Clean up input
@@ -306,9 +373,14 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 	req := &hook.Request{
 		ID:         middleware.GetReqID(r.Context()),
 		RawRequest: r,
+		RemoteAddr: middleware.GetClientAddr(r),
 	}
 
-	log.Printf("[%s] incoming HTTP %s request from %s\n", req.ID, r.Method, r.RemoteAddr)
+	if req.RemoteAddr != r.RemoteAddr {
+		log.Printf("[%s] incoming HTTP %s request from %s via proxy %s\n", req.ID, r.Method, req.RemoteAddr, r.RemoteAddr)
+	} else {
+		log.Printf("[%s] incoming HTTP %s request from %s\n", req.ID, r.Method, r.RemoteAddr)
+	}
 
 	// TODO: rename this to avoid confusion with Request.ID
 	id := mux.Vars(r)["id"]
@@ -320,6 +392,8 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.HookID = matchedHook.ID
+
 	// Check for allowed methods
 	var allowedMethod bool
 
@@ -351,27 +425,414 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if matchedHook.RateLimit != nil {
+		if ok, wait := matchedHook.RateLimit.Allow(req); !ok {
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, "Too many requests.")
+			log.Printf("[%s] rate limit exceeded for hook %q", req.ID, id)
+
+			return
+		}
+	}
+
+	if matchedHook.Auth != nil && !matchedHook.Auth.Authenticate(r) {
+		for _, c := range matchedHook.Auth.Challenges() {
+			w.Header().Add("WWW-Authenticate", c)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Unauthorized.")
+		log.Printf("[%s] unauthorized request for hook %q", req.ID, id)
+
+		return
+	}
+
 	log.Printf("[%s] %s got matched\n", req.ID, id)
 
 	for _, responseHeader := range responseHeaders {
 		w.Header().Set(responseHeader.Name, responseHeader.Value)
 	}
 
+	// Uploaded files are removed once the command has run, or when the
+	// hook is not triggered.
+	defer req.RemoveFiles()
+
+	if err := parseRequest(w, matchedHook, req, r); err != nil {
+		switch err.(type) {
+		case badRequestError:
+			w.WriteHeader(http.StatusBadRequest)
+		case requestTooLargeError:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case unsupportedEncodingError:
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	showTrace := matchedHook.DebugRules && isAdminRequest(r)
+
+	ok, trace, err := evaluateRules(matchedHook, req, *debug || showTrace)
+	if trace != nil && *debug {
+		log.Printf("[%s] rule evaluation trace:\n%s\n", req.ID, trace)
+	}
+
+	if err != nil {
+		if !hook.IsParameterNodeError(err) {
+			req.ForgetDeliveries()
+
+			msg := fmt.Sprintf("[%s] error evaluating hook: %s", req.ID, err)
+			log.Println(msg)
+
+			if showTrace {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			writeRulesResponse(w, "Error occurred while evaluating hook rules.", trace, showTrace)
+			return
+		}
+
+		log.Printf("[%s] %v", req.ID, err)
+	}
+	if ok {
+		// Forget the delivery if the hook fails, so that it can be
+		// retried.
+		sw := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if sw.status >= http.StatusInternalServerError {
+				req.ForgetDeliveries()
+			}
+		}()
+
+		if matchedHook.IdempotencyKey != nil {
+			if key, found := matchedHook.IdempotencyKey.Get(req); found {
+				triggerIdempotentHook(sw, matchedHook, req, key)
+				return
+			}
+		}
+
+		triggerHook(sw, matchedHook, req)
+		return
+	}
+
+	req.ForgetDeliveries()
+
+	if showTrace {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	// Check if a return code is configured for the hook
+	switch {
+	case req.TimeWindowMismatch != "" && matchedHook.TimeWindowMismatchHTTPResponseCode != 0:
+		log.Printf("[%s] %s got matched, but didn't get triggered because of its time window: %s\n", req.ID, matchedHook.ID, req.TimeWindowMismatch)
+		writeHTTPResponseCode(w, req.ID, matchedHook.ID, matchedHook.TimeWindowMismatchHTTPResponseCode)
+		writeRulesResponse(w, fmt.Sprintf("Hook is not available: %s.", req.TimeWindowMismatch), trace, showTrace)
+		return
+
+	case matchedHook.TriggerRuleMismatchHTTPResponseCode != 0:
+		writeHTTPResponseCode(w, req.ID, matchedHook.ID, matchedHook.TriggerRuleMismatchHTTPResponseCode)
+	}
+
+	// if none of the hooks got triggered
+	log.Printf("[%s] %s got matched, but didn't get triggered because the trigger rules were not satisfied\n", req.ID, matchedHook.ID)
+
+	writeRulesResponse(w, "Hook rules were not satisfied.", trace, showTrace)
+}
+
+// triggerHook triggers the hook and writes the response to the request.
+func triggerHook(w http.ResponseWriter, matchedHook *hook.Hook, req *hook.Request) {
+	log.Printf("[%s] %s hook triggered successfully\n", req.ID, matchedHook.ID)
+
+	for _, responseHeader := range matchedHook.ResponseHeaders {
+		w.Header().Set(responseHeader.Name, responseHeader.Value)
+	}
+
+	if matchedHook.ResponseContentType != "" {
+		w.Header().Set("Content-Type", matchedHook.ResponseContentType)
+	}
+
+	if matchedHook.CaptureCommandOutput {
+		response, err := job.HandleHook(matchedHook, req)
+
+		if err != nil {
+			if matchedHook.CaptureCommandOutputOnError {
+				response, rerr := renderResponse(matchedHook, req, response, exitCode(err))
+				if rerr != nil {
+					writeRenderError(w, req.ID, rerr)
+					return
+				}
+
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, response)
+			} else {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, "Error occurred while executing the hook's command. Please check your logs for more details.")
+			}
+		} else {
+			response, err = renderResponse(matchedHook, req, response, 0)
+			if err != nil {
+				writeRenderError(w, req.ID, err)
+				return
+			}
+
+			// Check if a success return code is configured for the hook
+			if matchedHook.SuccessHTTPResponseCode != 0 {
+				writeHTTPResponseCode(w, req.ID, matchedHook.ID, matchedHook.SuccessHTTPResponseCode)
+			}
+			fmt.Fprint(w, response)
+		}
+	} else {
+		// The command runs after the response is sent, so there is no
+		// output to render.
+		body := ""
+		if !matchedHook.HasResponseTemplate() {
+			body = matchedHook.ResponseMessage
+		}
+
+		response, err := renderResponse(matchedHook, req, body, 0)
+		if err != nil {
+			writeRenderError(w, req.ID, err)
+			return
+		}
+
+		//go handleHook(matchedHook, req)
+		job.Push(job.HookEvent{Hook: *matchedHook, Request: *req})
+
+		// The uploaded files are now removed by the queued job.
+		req.Files = nil
+
+		// Check if a success return code is configured for the hook
+		if matchedHook.SuccessHTTPResponseCode != 0 {
+			writeHTTPResponseCode(w, req.ID, matchedHook.ID, matchedHook.SuccessHTTPResponseCode)
+		}
+
+		fmt.Fprint(w, response)
+	}
+}
+
+// triggerIdempotentHook triggers the hook unless a request with the same
+// idempotency key was already handled, in which case the recorded response is
+// written instead.
+func triggerIdempotentHook(w http.ResponseWriter, matchedHook *hook.Hook, req *hook.Request, key string) {
+	key = matchedHook.ID + "\x00" + key
+
+	resp, err := idempotencyStore.Begin(key, matchedHook.IdempotencyKey.Duration())
+	if err == idempotency.ErrInFlight {
+		log.Printf("[%s] %s got matched, but a request with the same idempotency key is in flight\n", req.ID, matchedHook.ID)
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, "A request with the same idempotency key is in progress.")
+		return
+	}
+
+	if resp != nil {
+		log.Printf("[%s] %s got matched, returning the recorded response to a request with the same idempotency key\n", req.ID, matchedHook.ID)
+
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Body)
+		return
+	}
+
+	rec := &responseRecorder{ResponseWriter: w}
+	triggerHook(rec, matchedHook, req)
+
+	// Let failed requests be retried.
+	if rec.status >= http.StatusInternalServerError {
+		idempotencyStore.Abort(key)
+		return
+	}
+
+	if err := idempotencyStore.Finish(key, rec.response()); err != nil {
+		log.Printf("[%s] error recording the response to idempotency key: %v", req.ID, err)
+	}
+}
+
+// responseRecorder records the status and body of a response as they are
+// written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	r.body.Write(b)
+
+	return r.ResponseWriter.Write(b)
+}
+
+// response returns the recorded response.
+func (r *responseRecorder) response() *idempotency.Response {
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	header := make(map[string][]string, len(r.Header()))
+	for k, v := range r.Header() {
+		header[k] = append([]string(nil), v...)
+	}
+
+	return &idempotency.Response{Status: status, Header: header, Body: r.body.Bytes()}
+}
+
+// statusRecorder is a response writer that records the status of the
+// response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// requestError is an error parsing a request. Its message is the body of the
+// response to the request.
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+// requestTooLargeError is an error parsing a request that exceeds a size or
+// count limit. It is answered with 413 Request Entity Too Large.
+type requestTooLargeError string
+
+func (e requestTooLargeError) Error() string {
+	return string(e)
+}
+
+// badRequestError is an error parsing a malformed request. It is answered
+// with 400 Bad Request.
+type badRequestError string
+
+func (e badRequestError) Error() string {
+	return string(e)
+}
+
+// unsupportedEncodingError is an error decoding a request body with a content
+// coding that is not supported. It is answered with 415 Unsupported Media
+// Type.
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+	return string(e)
+}
+
+// maxBodySize returns the maximum size of the body of requests to the hook h,
+// or 0 if the size is not limited.
+func maxBodySize(h *hook.Hook) int64 {
+	switch {
+	case h.MaxBodySize < 0:
+		return 0
+	case h.MaxBodySize > 0:
+		return h.MaxBodySize
+	}
+
+	return *maxBody
+}
+
+// dumpedBodySize returns the maximum size of the body of the request r
+// dumped with -debug, which is the maximum body size of the hook the request
+// is sent to.
+func dumpedBodySize(r *http.Request) int64 {
+	if h := matchLoadedHook(mux.Vars(r)["id"]); h != nil {
+		return maxBodySize(h)
+	}
+
+	return *maxBody
+}
+
+// bodyTooLarge logs and returns the error for a request body larger than max
+// bytes.
+func bodyTooLarge(req *hook.Request, max int64) error {
+	log.Printf("[%s] request body is larger than %d bytes\n", req.ID, max)
+	return requestTooLargeError(fmt.Sprintf("Request body is larger than %d bytes.", max))
+}
+
+// isBodyTooLarge returns true if err is the error of a body limited by
+// http.MaxBytesReader that is larger than the limit. The error has no type
+// of its own before Go 1.19.
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// parseRequest reads the body of the HTTP request r into req and parses the
+// headers, query and payload for the hook h. The response writer w, if not
+// nil, is told to close the connection if the body is too large.
+func parseRequest(w http.ResponseWriter, h *hook.Hook, req *hook.Request, r *http.Request) error {
 	var err error
 
 	// set contentType to IncomingPayloadContentType or header value
 	req.ContentType = r.Header.Get("Content-Type")
-	if len(matchedHook.IncomingPayloadContentType) != 0 {
-		req.ContentType = matchedHook.IncomingPayloadContentType
+	if len(h.IncomingPayloadContentType) != 0 {
+		req.ContentType = h.IncomingPayloadContentType
 	}
 
 	isMultipart := strings.HasPrefix(req.ContentType, "multipart/form-data;")
 
+	max := maxBodySize(h)
+	if max > 0 {
+		if r.ContentLength > max {
+			return bodyTooLarge(req, max)
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+
 	if !isMultipart {
 		req.Body, err = ioutil.ReadAll(r.Body)
+		if isBodyTooLarge(err) {
+			return bodyTooLarge(req, max)
+		}
 		if err != nil {
 			log.Printf("[%s] error reading the request body: %+v\n", req.ID, err)
 		}
+
+		if enc := strings.Join(r.Header.Values("Content-Encoding"), ","); enc != "" {
+			err = req.DecodeBody(enc, *maxDecompressed)
+			switch {
+			case err == hook.ErrBodyTooLarge:
+				log.Printf("[%s] decoded request body is larger than %d bytes\n", req.ID, *maxDecompressed)
+				return requestTooLargeError(fmt.Sprintf("Decoded request body is larger than %d bytes.", *maxDecompressed))
+			case hook.IsUnsupportedEncodingError(err):
+				log.Printf("[%s] %s\n", req.ID, err)
+				return unsupportedEncodingError(fmt.Sprintf("Unsupported content encoding %q.", err.(*hook.UnsupportedEncodingError).Encoding))
+			case err != nil:
+				log.Printf("[%s] %s\n", req.ID, err)
+				return badRequestError("Error occurred while decoding the request body.")
+			}
+		}
 	}
 
 	req.ParseHeaders(r.Header)
@@ -397,77 +858,15 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case isMultipart:
-		err = r.ParseMultipartForm(*maxMultipartMem)
-		if err != nil {
-			msg := fmt.Sprintf("[%s] error parsing multipart form: %+v\n", req.ID, err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Error occurred while parsing multipart form.")
-			return
-		}
-
-		for k, v := range r.MultipartForm.Value {
-			log.Printf("[%s] found multipart form value %q", req.ID, k)
-
-			if req.Payload == nil {
-				req.Payload = make(map[string]interface{})
-			}
-
-			// TODO(moorereason): support duplicate, named values
-			req.Payload[k] = v[0]
-		}
-
-		for k, v := range r.MultipartForm.File {
-			// Force parsing as JSON regardless of Content-Type.
-			var parseAsJSON bool
-			for _, j := range matchedHook.JSONStringParameters {
-				if j.Source == "payload" && j.Name == k {
-					parseAsJSON = true
-					break
+		if err := parseMultipart(h, req, r); err != nil {
+			// The limited body keeps failing once it is too large.
+			if max > 0 {
+				if _, rerr := r.Body.Read(nil); isBodyTooLarge(rerr) {
+					return bodyTooLarge(req, max)
 				}
 			}
 
-			// TODO(moorereason): we need to support multiple parts
-			// with the same name instead of just processing the first
-			// one. Will need #215 resolved first.
-
-			// MIME encoding can contain duplicate headers, so check them
-			// all.
-			if !parseAsJSON && len(v[0].Header["Content-Type"]) > 0 {
-				for _, j := range v[0].Header["Content-Type"] {
-					if j == "application/json" {
-						parseAsJSON = true
-						break
-					}
-				}
-			}
-
-			if parseAsJSON {
-				log.Printf("[%s] parsing multipart form file %q as JSON\n", req.ID, k)
-
-				f, err := v[0].Open()
-				if err != nil {
-					msg := fmt.Sprintf("[%s] error parsing multipart form file: %+v\n", req.ID, err)
-					log.Println(msg)
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprint(w, "Error occurred while parsing multipart form file.")
-					return
-				}
-
-				decoder := json.NewDecoder(f)
-				decoder.UseNumber()
-
-				var part map[string]interface{}
-				err = decoder.Decode(&part)
-				if err != nil {
-					log.Printf("[%s] error parsing JSON payload file: %+v\n", req.ID, err)
-				}
-
-				if req.Payload == nil {
-					req.Payload = make(map[string]interface{})
-				}
-				req.Payload[k] = part
-			}
+			return err
 		}
 
 	default:
@@ -475,81 +874,86 @@ func hookHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// handle hook
-	errors := matchedHook.ParseJSONParameters(req)
+	errors := h.ParseJSONParameters(req)
 	for _, err := range errors {
 		log.Printf("[%s] error parsing JSON parameters: %s\n", req.ID, err)
 	}
 
-	var ok bool
+	return nil
+}
 
-	if matchedHook.TriggerRule == nil {
-		ok = true
-	} else {
-		// Save signature soft failures option in request for evaluators
-		req.AllowSignatureErrors = matchedHook.TriggerSignatureSoftFailures
+// evaluateRules evaluates the trigger rules of the hook h. The trace of the
+// evaluation is returned if trace is set.
+func evaluateRules(h *hook.Hook, req *hook.Request, trace bool) (bool, *hook.RuleTrace, error) {
+	if h.TriggerRule == nil {
+		return true, nil, nil
+	}
 
-		ok, err = matchedHook.TriggerRule.Evaluate(req)
-		if err != nil {
-			if !hook.IsParameterNodeError(err) {
-				msg := fmt.Sprintf("[%s] error evaluating hook: %s", req.ID, err)
-				log.Println(msg)
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprint(w, "Error occurred while evaluating hook rules.")
-				return
-			}
+	// Save signature soft failures option in request for evaluators
+	req.AllowSignatureErrors = h.TriggerSignatureSoftFailures
 
-			log.Printf("[%s] %v", req.ID, err)
-		}
+	if trace {
+		return h.TriggerRule.Trace(req)
 	}
 
-	if ok {
-		log.Printf("[%s] %s hook triggered successfully\n", req.ID, matchedHook.ID)
-
-		for _, responseHeader := range matchedHook.ResponseHeaders {
-			w.Header().Set(responseHeader.Name, responseHeader.Value)
-		}
+	ok, err := h.TriggerRule.Evaluate(req)
 
-		if matchedHook.CaptureCommandOutput {
-			response, err := job.HandleHook(matchedHook, req)
+	return ok, nil, err
+}
 
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				if matchedHook.CaptureCommandOutputOnError {
-					fmt.Fprint(w, response)
-				} else {
-					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-					fmt.Fprint(w, "Error occurred while executing the hook's command. Please check your logs for more details.")
-				}
-			} else {
-				// Check if a success return code is configured for the hook
-				if matchedHook.SuccessHTTPResponseCode != 0 {
-					writeHTTPResponseCode(w, req.ID, matchedHook.ID, matchedHook.SuccessHTTPResponseCode)
-				}
-				fmt.Fprint(w, response)
-			}
-		} else {
-			//go handleHook(matchedHook, req)
-			job.Push(job.HookEvent{Hook: *matchedHook, Request: *req})
+// isAdminRequest returns true if the request carries the -admin-token.
+func isAdminRequest(r *http.Request) bool {
+	token := r.Header.Get(adminTokenHeader)
 
-			// Check if a success return code is configured for the hook
-			if matchedHook.SuccessHTTPResponseCode != 0 {
-				writeHTTPResponseCode(w, req.ID, matchedHook.ID, matchedHook.SuccessHTTPResponseCode)
-			}
+	return *adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
 
-			fmt.Fprint(w, matchedHook.ResponseMessage)
-		}
+// writeRulesResponse writes the response message for a hook that was not
+// triggered, along with the rule evaluation trace if showTrace is set.
+func writeRulesResponse(w http.ResponseWriter, msg string, trace *hook.RuleTrace, showTrace bool) {
+	if !showTrace {
+		fmt.Fprint(w, msg)
 		return
 	}
 
-	// Check if a return code is configured for the hook
-	if matchedHook.TriggerRuleMismatchHTTPResponseCode != 0 {
-		writeHTTPResponseCode(w, req.ID, matchedHook.ID, matchedHook.TriggerRuleMismatchHTTPResponseCode)
+	json.NewEncoder(w).Encode(struct {
+		Message string          `json:"message"`
+		Trace   *hook.RuleTrace `json:"trace"`
+	}{msg, trace})
+}
+
+// renderResponse returns the response body for a triggered hook. If the hook
+// has a response template, it is rendered with the request and the command's
+// output and exit code; otherwise, body is returned unchanged.
+func renderResponse(h *hook.Hook, req *hook.Request, body string, code int) (string, error) {
+	if !h.HasResponseTemplate() {
+		return body, nil
 	}
 
-	// if none of the hooks got triggered
-	log.Printf("[%s] %s got matched, but didn't get triggered because the trigger rules were not satisfied\n", req.ID, matchedHook.ID)
+	return h.RenderResponse(&hook.ResponseData{
+		ID:       h.ID,
+		Request:  req,
+		Output:   body,
+		ExitCode: code,
+	})
+}
 
-	fmt.Fprint(w, "Hook rules were not satisfied.")
+func writeRenderError(w http.ResponseWriter, rid string, err error) {
+	log.Printf("[%s] error rendering response template: %s\n", rid, err)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprint(w, "Error occurred while rendering the hook's response.")
+}
+
+// exitCode returns the exit code of a command that failed with err, or -1 if
+// the command did not run to completion.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
 }
 
 func writeHTTPResponseCode(w http.ResponseWriter, rid, hookID string, responseCode int) {
@@ -568,7 +972,13 @@ func reloadHooks(hooksFilePath string) {
 	// parse and swap
 	log.Printf("attempting to reload hooks from %s\n", hooksFilePath)
 
-	err := hooksInFile.LoadFromFile(hooksFilePath, *asTemplate)
+	rulesFilePath, err := hooksInFile.LoadFromFileWithRulesFile(hooksFilePath, *asTemplate)
+
+	// Watch the rules file even if it can not be loaded, so that the hooks
+	// are reloaded once it is fixed.
+	if err == nil || rulesFilePath != "" {
+		setRulesFile(hooksFilePath, rulesFilePath)
+	}
 
 	if err != nil {
 		log.Printf("couldn't load hooks from file! %+v\n", err)
@@ -597,6 +1007,14 @@ func reloadHooks(hooksFilePath string) {
 			log.Printf("\tloaded: %s\n", hook.ID)
 		}
 
+		// Keep the rate limits of unchanged hooks.
+		loaded := loadedHooksFromFiles[hooksFilePath]
+		for i := range hooksInFile {
+			if old := loaded.Match(hooksInFile[i].ID); old != nil && hooksInFile[i].RateLimit != nil {
+				hooksInFile[i].RateLimit.Inherit(old.RateLimit)
+			}
+		}
+
 		loadedHooksFromFiles[hooksFilePath] = hooksInFile
 	}
 }
@@ -621,6 +1039,8 @@ func removeHooks(hooksFilePath string) {
 
 	hooksFiles = newHooksFiles
 
+	setRulesFile(hooksFilePath, "")
+
 	removedHooksCount := len(loadedHooksFromFiles[hooksFilePath])
 
 	delete(loadedHooksFromFiles, hooksFilePath)
@@ -633,11 +1053,99 @@ func removeHooks(hooksFilePath string) {
 	}
 }
 
+// setRulesFile records the rules file loaded by a hooks file, watching it
+// for changes if hot reloading is enabled.
+func setRulesFile(hooksFilePath, rulesFilePath string) {
+	old := rulesFiles[hooksFilePath]
+
+	if rulesFilePath == "" {
+		delete(rulesFiles, hooksFilePath)
+	} else {
+		rulesFiles[hooksFilePath] = rulesFilePath
+		watchRulesFile(rulesFilePath)
+	}
+
+	if old == "" || old == rulesFilePath || watcher == nil {
+		return
+	}
+
+	// Stop watching the old rules file unless it is still in use.
+	if len(hooksFilesUsing(old)) == 0 && !isHooksFile(old) {
+		log.Printf("no longer watching rules file %s\n", old)
+		watcher.Remove(old)
+	}
+}
+
+// watchRulesFile adds a rules file to the file watcher, if hot reloading is
+// enabled.
+func watchRulesFile(path string) {
+	if watcher == nil {
+		return
+	}
+
+	// Adding a file that is already watched has no effect.
+	if err := watcher.Add(path); err != nil {
+		log.Printf("error adding rules file %s to the watcher: %s\n", path, err)
+	}
+}
+
+// hooksFilesUsing returns the hooks files loading the rules file at path.
+func hooksFilesUsing(rulesFilePath string) []string {
+	var files []string
+
+	for _, hooksFilePath := range hooksFiles {
+		if rulesFiles[hooksFilePath] == rulesFilePath {
+			files = append(files, hooksFilePath)
+		}
+	}
+
+	return files
+}
+
+func isHooksFile(path string) bool {
+	for _, hooksFilePath := range hooksFiles {
+		if hooksFilePath == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleRulesFileChange reloads the hooks files loading a changed rules file.
+func handleRulesFileChange(event fsnotify.Event, hooksFilePaths []string) {
+	switch {
+	case event.Op&fsnotify.Write == fsnotify.Write:
+		log.Printf("rules file %s modified\n", event.Name)
+
+	case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		time.Sleep(100 * time.Millisecond)
+		if _, err := os.Stat(event.Name); os.IsNotExist(err) {
+			log.Printf("rules file %s removed, keeping the hooks that were loaded from it\n", event.Name)
+			return
+		}
+
+		// file was overwritten
+		log.Printf("rules file %s overwritten\n", event.Name)
+		(*watcher).Remove(event.Name)
+		(*watcher).Add(event.Name)
+
+	default:
+		return
+	}
+
+	for _, hooksFilePath := range hooksFilePaths {
+		reloadHooks(hooksFilePath)
+	}
+}
+
 func watchForFileChange() {
 	for {
 		select {
 		case event := <-(*watcher).Events:
-			if event.Op&fsnotify.Write == fsnotify.Write {
+			if files := hooksFilesUsing(event.Name); len(files) != 0 && !isHooksFile(event.Name) {
+				handleRulesFileChange(event, files)
+			} else if event.Op&fsnotify.Write == fsnotify.Write {
 				log.Printf("hooks file %s modified\n", event.Name)
 				reloadHooks(event.Name)
 			} else if event.Op&fsnotify.Remove == fsnotify.Remove {
@@ -667,19 +1175,6 @@ func watchForFileChange() {
 	}
 }
 
-// valuesToMap converts map[string][]string to a map[string]string object
-func valuesToMap(values map[string][]string) map[string]interface{} {
-	ret := make(map[string]interface{})
-
-	for key, value := range values {
-		if len(value) > 0 {
-			ret[key] = value[0]
-		}
-	}
-
-	return ret
-}
-
 // makeRoutePattern builds a pattern matching URL for the mux.
 func makeRoutePattern(prefix *string) string {
 	return makeBaseURL(prefix) + "/{id:.*}"
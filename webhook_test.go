@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -69,6 +74,89 @@ func TestStaticParams(t *testing.T) {
 	}
 }
 
+func TestEphemeralWorkspace(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping on Windows")
+	}
+
+	tmpl, err := ioutil.TempDir("", "webhook-workspace-template-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpl)
+
+	// Read-only template directories are copied as well.
+	seed := filepath.Join(tmpl, "seed")
+	if err := os.Mkdir(seed, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(seed, "seed.txt"), []byte("seeded"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(seed, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(seed, 0755)
+
+	script := filepath.Join(tmpl, "run.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\ncat seed/seed.txt\necho \" $HOOK_WORKSPACE\"\ncat \"$HOOK_FILE\"\nexit $1\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		desc string
+		code string
+		keep bool
+		ok   bool
+		kept bool
+	}{
+		{"success", "0", true, true, false},
+		{"failure", "1", false, false, false},
+		{"failure with keep", "1", true, false, true},
+	} {
+		h := &hook.Hook{
+			ID:                     "ephemeral/workspace",
+			ExecuteCommand:         "run.sh",
+			Workspace:              hook.WorkspaceEphemeral,
+			WorkspaceTemplate:      tmpl,
+			KeepWorkspaceOnFailure: tt.keep,
+			PassArgumentsToCommand: []hook.Argument{
+				{Source: "string", Name: tt.code},
+			},
+			PassFileToCommand: []hook.Argument{
+				{Source: "string", Name: " file", EnvName: "HOOK_FILE"},
+			},
+		}
+
+		out, err := job.HandleHook(h, &hook.Request{ID: "test"})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error: %v\n%s", tt.desc, err, out)
+			continue
+		}
+
+		fields := strings.Fields(out)
+		if len(fields) != 3 || fields[0] != "seeded" || fields[2] != "file" {
+			t.Errorf("%s: unexpected output: %q", tt.desc, out)
+			continue
+		}
+
+		workspace := fields[1]
+		if !strings.HasPrefix(workspace, filepath.Join(os.TempDir(), "webhook-ephemeral-workspace-test-")) {
+			t.Errorf("%s: unexpected workspace path: %q", tt.desc, workspace)
+		}
+
+		_, err = os.Stat(workspace)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: expected workspace kept: %v, got: %v", tt.desc, tt.kept, kept)
+		}
+		os.RemoveAll(workspace)
+	}
+}
+
 func TestWebhook(t *testing.T) {
 	hookecho, cleanupHookecho := buildHookecho(t)
 	defer cleanupHookecho()
@@ -83,7 +171,7 @@ func TestWebhook(t *testing.T) {
 		for _, tt := range hookHandlerTests {
 			t.Run(tt.desc+"@"+hookTmpl, func(t *testing.T) {
 				ip, port := serverAddress(t)
-				args := []string{fmt.Sprintf("-hooks=%s", configPath), fmt.Sprintf("-ip=%s", ip), fmt.Sprintf("-port=%s", port), "-debug"}
+				args := []string{fmt.Sprintf("-hooks=%s", configPath), fmt.Sprintf("-ip=%s", ip), fmt.Sprintf("-port=%s", port), "-debug", "-admin-token=admin"}
 
 				if len(tt.cliMethods) != 0 {
 					args = append(args, "-http-methods="+strings.Join(tt.cliMethods, ","))
@@ -166,6 +254,180 @@ func TestWebhook(t *testing.T) {
 	}
 }
 
+func TestDryRun(t *testing.T) {
+	hookecho, cleanupHookecho := buildHookecho(t)
+	defer cleanupHookecho()
+
+	webhook, cleanupWebhookFn := buildWebhook(t)
+	defer cleanupWebhookFn()
+
+	configPath, cleanupConfigFn := genConfig(t, hookecho, "test/hooks.json.tmpl")
+	defer cleanupConfigFn()
+
+	for _, tt := range []struct {
+		desc     string
+		id       string
+		args     []string
+		body     string
+		exitCode int
+		output   string
+	}{
+		{"triggered", "debug-rules", nil, `{"ref": "refs/heads/main", "token": "s3cret"}`, 0, `(?s)^and: true\n.*match value payload token="\[redacted\]": true\nhook "debug-rules" would be triggered\n$`},
+		{"not triggered", "debug-rules", nil, `{"ref": "refs/heads/dev"}`, 1, `(?s)match value payload ref="refs/heads/dev": false\nhook "debug-rules" would not be triggered\n$`},
+		{"unknown hook", "missing", nil, `{}`, 2, `^error: hook "missing" not found\n$`},
+		{"default remote address", "ip-whitelist", nil, `{}`, 0, `hook "ip-whitelist" would be triggered\n$`},
+		{"remote address", "ip-whitelist", []string{"-dry-run-remote-addr=198.51.100.7:0"}, `{}`, 1, `hook "ip-whitelist" would not be triggered\n$`},
+	} {
+		request := "POST /hooks/" + tt.id + " HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\n" +
+			fmt.Sprintf("Content-Length: %d\r\n\r\n", len(tt.body)) + tt.body
+
+		args := append([]string{"-hooks=" + configPath, "-dry-run=" + tt.id}, tt.args...)
+
+		cmd := exec.Command(webhook, args...)
+		cmd.Stdin = strings.NewReader(request)
+		cmd.Env = webhookEnv()
+
+		out, err := cmd.Output()
+
+		exitCode := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		if exitCode != tt.exitCode || !regexp.MustCompile(tt.output).Match(out) {
+			t.Errorf("%s: expected exit code %d and output matching %q, got %d:\n%s", tt.desc, tt.exitCode, tt.output, exitCode, out)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	hookecho, cleanupHookecho := buildHookecho(t)
+	defer cleanupHookecho()
+
+	webhook, cleanupWebhookFn := buildWebhook(t)
+	defer cleanupWebhookFn()
+
+	configPath, cleanupConfigFn := genConfig(t, hookecho, "test/hooks.json.tmpl")
+	defer cleanupConfigFn()
+
+	ip, port := serverAddress(t)
+
+	b := &buffer{}
+
+	cmd := exec.Command(webhook, "-hooks="+configPath, "-ip="+ip, "-port="+port, "-debug")
+	cmd.Stderr = b
+	cmd.Env = webhookEnv()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start webhook: %s", err)
+	}
+	defer killAndWait(cmd)
+
+	waitForServerReady(t, ip, port)
+
+	url := fmt.Sprintf("http://%s:%s/hooks/idempotent", ip, port)
+
+	for _, tt := range []struct {
+		desc       string
+		delivery   string
+		value      string
+		respStatus int
+		respBody   string
+	}{
+		{"first delivery", "1", "first", http.StatusOK, `arg: first`},
+		{"repeated delivery", "1", "second", http.StatusOK, `arg: first`},
+		{"new delivery", "2", "third", http.StatusOK, `arg: third`},
+		{"no key", "", "fourth", http.StatusOK, `arg: fourth`},
+		{"repeated request without key", "", "fifth", http.StatusOK, `arg: fifth`},
+	} {
+		req, err := http.NewRequest("POST", url, strings.NewReader(fmt.Sprintf(`{"value": %q}`, tt.value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		if tt.delivery != "" {
+			req.Header.Set("X-Delivery", tt.delivery)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		if res.StatusCode != tt.respStatus || !regexp.MustCompile(tt.respBody).Match(body) {
+			t.Errorf("%s: expected status %d and body matching %q, got %d: %s", tt.desc, tt.respStatus, tt.respBody, res.StatusCode, body)
+		}
+	}
+
+	killAndWait(cmd)
+
+	if !strings.Contains(b.String(), "returning the recorded response to a request with the same idempotency key") {
+		t.Errorf("expected the recorded response to be logged:\n%s", b)
+	}
+}
+
+func TestParseRequestBodyLimit(t *testing.T) {
+	h := &hook.Hook{ID: "test", MaxBodySize: 16}
+
+	for _, tt := range []struct {
+		desc        string
+		contentType string
+		body        string
+		tooLarge    bool
+	}{
+		{"within limit", "application/json", `{"a": "z"}`, false},
+		{"at limit", "application/json", `{"a": "0123456"}`, false},
+		{"over limit", "application/json", `{"a": "01234567"}`, true},
+		{"multipart over limit", "multipart/form-data; boundary=xxx", "--xxx\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nz\r\n--xxx--\r\n", true},
+	} {
+		// Without a Content-Length, the limit is enforced while the body
+		// is read.
+		r, err := http.NewRequest("POST", "/hooks/test", ioutil.NopCloser(strings.NewReader(tt.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", tt.contentType)
+
+		req := &hook.Request{ID: "test", RawRequest: r}
+
+		err = parseRequest(httptest.NewRecorder(), h, req, r)
+		req.RemoveFiles()
+
+		if _, ok := err.(requestTooLargeError); ok != tt.tooLarge {
+			t.Errorf("%s: expected too large %t, got error %v", tt.desc, tt.tooLarge, err)
+		}
+
+		if !tt.tooLarge && string(req.Body) != tt.body {
+			t.Errorf("%s: expected body %q, got %q", tt.desc, tt.body, req.Body)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	defer func(v int64) { *maxBody = v }(*maxBody)
+	*maxBody = 16
+
+	for _, tt := range []struct {
+		size, max int64
+	}{
+		{0, 16},
+		{8, 8},
+		{-1, 0},
+	} {
+		if max := maxBodySize(&hook.Hook{ID: "test", MaxBodySize: tt.size}); max != tt.max {
+			t.Errorf("max-body-size %d: expected %d, got %d", tt.size, tt.max, max)
+		}
+	}
+}
+
 func buildHookecho(t *testing.T) (binPath string, cleanupFn func()) {
 	tmp, err := ioutil.TempDir("", "hookecho-test-")
 	if err != nil {
@@ -983,6 +1245,165 @@ binary data
 		``,
 	},
 
+	{
+		"multipart files",
+		"upload",
+		nil,
+		"POST",
+		nil,
+		"multipart/form-data; boundary=xxx",
+		`--xxx
+Content-Disposition: form-data; name="note"
+
+hello
+--xxx
+Content-Disposition: form-data; name="upload"; filename="a.txt"
+Content-Type: text/plain
+
+first
+--xxx
+Content-Disposition: form-data; name="upload"; filename="b.json"
+Content-Type: application/json
+
+{"x": 1}
+--xxx--`,
+		false,
+		http.StatusOK,
+		`^arg: a.txt b.json application/json 5 hello\nenv: HOOK_UPLOAD=.*webhook-upload-\d+\n$`,
+		`(?s)saved multipart form file "upload" \(a.txt, 5 bytes\).*removing uploaded file`,
+	},
+	{
+		"multipart too many files",
+		"upload",
+		nil,
+		"POST",
+		nil,
+		"multipart/form-data; boundary=xxx",
+		`--xxx
+Content-Disposition: form-data; name="upload"; filename="a.txt"
+
+a
+--xxx
+Content-Disposition: form-data; name="upload"; filename="b.txt"
+
+b
+--xxx
+Content-Disposition: form-data; name="upload"; filename="c.txt"
+
+c
+--xxx--`,
+		false,
+		http.StatusRequestEntityTooLarge,
+		`Multipart form has more than 2 files.`,
+		`multipart form has more than 2 files`,
+	},
+	{
+		"multipart file too large",
+		"upload",
+		nil,
+		"POST",
+		nil,
+		"multipart/form-data; boundary=xxx",
+		`--xxx
+Content-Disposition: form-data; name="upload"; filename="a.txt"
+
+0123456789012345678901234567890123456789
+--xxx--`,
+		false,
+		http.StatusRequestEntityTooLarge,
+		`Multipart form file is larger than 32 bytes.`,
+		`multipart form file "upload" is larger than 32 bytes`,
+	},
+
+	{
+		"gzip compressed",
+		"compressed",
+		nil,
+		"POST",
+		map[string]string{
+			"Content-Encoding":    "gzip",
+			"X-Signature":         signSHA256(gzipBody),
+			"X-Decoded-Signature": signSHA256(gzipPayload),
+		},
+		"application/json",
+		gzipBody,
+		false,
+		http.StatusOK,
+		`^arg: refs/heads/main\n$`,
+		``,
+	},
+	{
+		"gzip compressed signed over decoded body",
+		"compressed",
+		nil,
+		"POST",
+		map[string]string{
+			"Content-Encoding":    "gzip",
+			"X-Signature":         signSHA256(gzipPayload),
+			"X-Decoded-Signature": signSHA256(gzipPayload),
+		},
+		"application/json",
+		gzipBody,
+		false,
+		http.StatusInternalServerError,
+		`Error occurred while evaluating hook rules.`,
+		``,
+	},
+
+	{
+		"unsupported content encoding",
+		"compressed",
+		nil,
+		"POST",
+		map[string]string{"Content-Encoding": "br"},
+		"application/json",
+		gzipBody,
+		false,
+		http.StatusUnsupportedMediaType,
+		`Unsupported content encoding "br".`,
+		`unsupported content encoding "br"`,
+	},
+	{
+		"corrupt gzip body",
+		"compressed",
+		nil,
+		"POST",
+		map[string]string{"Content-Encoding": "gzip"},
+		"application/json",
+		gzipPayload,
+		false,
+		http.StatusBadRequest,
+		`Error occurred while decoding the request body.`,
+		`error decoding gzip request body`,
+	},
+
+	{
+		"body within the hook's size limit",
+		"small-body",
+		nil,
+		"POST",
+		nil,
+		"application/json",
+		`{"a": "z"}`,
+		false,
+		http.StatusOK,
+		`^arg: z\n$`,
+		``,
+	},
+	{
+		"body over the hook's size limit",
+		"small-body",
+		nil,
+		"POST",
+		nil,
+		"application/json",
+		`{"a": "0123456789"}`,
+		false,
+		http.StatusRequestEntityTooLarge,
+		`^Request body is larger than 16 bytes.$`,
+		`(?s)Request body is larger than 16 bytes, not dumping it.*\[[a-f0-9-]+\] request body is larger than 16 bytes`,
+	},
+
 	{
 		"issue-471",
 		"issue-471",
@@ -1145,12 +1566,46 @@ env: HOOK_head_commit.timestamp=2013-03-12T08:14:29-07:00
 	{"capture output on error with extra flag set", "capture-command-output-on-error-yes-with-extra-flag", nil, "POST", nil, "application/json", `{}`, false, http.StatusInternalServerError, `arg: exit=1
 `, ``},
 
+	// test response templates, authentication, rule traces and time windows
+	{"response template", "response-template", nil, "POST", nil, "application/json", `{"user": "bob"}`, false, http.StatusOK, `{"user": "bob", "output": "arg: hi\\n", "code": 0}`, ``},
+	{"async response template", "async-response-template", nil, "POST", nil, "application/json", `{}`, false, http.StatusOK, `^queued async-response-template, output: ""$`, ``},
+	{"basic auth", "auth", nil, "POST", map[string]string{"Authorization": "Basic Ym9iOnNlY3JldA=="}, "application/json", `{}`, false, http.StatusOK, `authenticated`, ``},
+	{"bearer token auth", "auth", nil, "POST", map[string]string{"Authorization": "Bearer token"}, "application/json", `{}`, false, http.StatusOK, `authenticated`, ``},
+	{"wrong basic auth password", "auth", nil, "POST", map[string]string{"Authorization": "Basic Ym9iOndyb25n"}, "application/json", `{}`, false, http.StatusUnauthorized, `Unauthorized.`, `(?s)unauthorized request for hook "auth"`},
+	{"missing auth", "auth", nil, "POST", nil, "application/json", `{}`, false, http.StatusUnauthorized, `Unauthorized.`, ``},
+	{"debug rules trace", "debug-rules", nil, "POST", map[string]string{"X-Webhook-Admin-Token": "admin"}, "application/json", `{"ref": "refs/heads/main", "token": "guess"}`, false, http.StatusOK, `^\{"message":"Hook rules were not satisfied.","trace":\{"rule":"and","result":false,"children":\[\{"rule":"match","type":"value","parameter":"payload ref","value":"refs/heads/main","result":true\},\{"rule":"match","type":"value","parameter":"payload token","value":"\[redacted\]","result":false\}\]\}\}\n$`, `(?s)rule evaluation trace:\nand: false\n  match value payload ref="refs/heads/main": true`},
+	{"debug rules without admin token", "debug-rules", nil, "POST", map[string]string{"X-Webhook-Admin-Token": "wrong"}, "application/json", `{"ref": "refs/heads/dev"}`, false, http.StatusOK, `^Hook rules were not satisfied.$`, ``},
+	{"debug rules triggered", "debug-rules", nil, "POST", map[string]string{"X-Webhook-Admin-Token": "admin"}, "application/json", `{"ref": "refs/heads/main", "token": "s3cret"}`, false, http.StatusOK, `^triggered$`, ``},
+	{"time window mismatch", "time-window", nil, "POST", nil, "application/json", `{}`, false, http.StatusServiceUnavailable, `^Hook is not available: blackout period: deploy freeze.$`, `(?s)didn't get triggered because of its time window: blackout period: deploy freeze`},
+
 	// Check logs
 	{"static params should pass", "static-params-ok", nil, "POST", nil, "application/json", `{}`, false, http.StatusOK, "arg: passed\n", `(?s)command output: arg: passed`},
 	{"command with space logs warning", "warn-on-space", nil, "POST", nil, "application/json", `{}`, false, http.StatusInternalServerError, "Error occurred while executing the hook's command. Please check your logs for more details.", `(?s)error in exec:.*use 'pass[-]arguments[-]to[-]command' to specify args`},
 	{"unsupported content type error", "github", nil, "POST", map[string]string{"Content-Type": "nonexistent/format"}, "application/json", `{}`, false, http.StatusBadRequest, `Hook rules were not satisfied.`, `(?s)error parsing body payload due to unsupported content type header:`},
 }
 
+// gzipPayload is sent gzip compressed as gzipBody.
+const gzipPayload = `{"ref": "refs/heads/main"}`
+
+var gzipBody = func() string {
+	var b bytes.Buffer
+
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(gzipPayload))
+	w.Close()
+
+	return b.String()
+}()
+
+// signSHA256 returns the payload-hmac-sha256 signature of s with the secret
+// used by the test hooks.
+func signSHA256(s string) string {
+	mac := hmac.New(sha256.New, []byte("mysecret"))
+	mac.Write([]byte(s))
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
 // buffer provides a concurrency-safe bytes.Buffer to tests above.
 type buffer struct {
 	b bytes.Buffer